@@ -24,6 +24,11 @@ const (
 // It will set predefined handler ID to the handler middlewares so we maitain
 // cardinality low instead of letting the middleware set the url path.
 // If also groupes the status codes.
+// It will set the trace ID of the requests as exemplars on the latency metrics, the exemplars
+// are only exposed using OpenMetrics format.
+// It will measure the latency with native histograms besides the classic buckets, the native
+// histograms are only exposed using the protobuf format (Prometheus negotiates it when the
+// native histograms feature is enabled).
 func main() {
 	// Crceate a custom registry for prometheus.
 	reg := prometheus.NewRegistry()
@@ -33,6 +38,11 @@ func main() {
 		Prefix:        "exampleapp",
 		Buckets:       []float64{1, 2.5, 5, 10, 20, 40, 80, 160, 320, 640},
 		GroupedStatus: true,
+		// Native histograms with a 10% max error on the latency quantiles, keep the classic buckets while migrating.
+		NativeHistogramBucketFactor:       1.1,
+		NativeHistogramWithClassicBuckets: true,
+		// If the requests have an OpenTelemetry trace, the latency will have the trace ID as an exemplar.
+		TraceIDExtractor: prommiddleware.OTelTraceID,
 	}
 	mdlw := prommiddleware.New(cfg, reg)
 
@@ -59,10 +69,11 @@ func main() {
 		}
 	}()
 
-	// Serve our metrics.
+	// Serve our metrics, the handler exposes the text, OpenMetrics or protobuf format based on the
+	// scraper accepted formats.
 	go func() {
 		log.Printf("metrics listening at %s", metricsAddr)
-		if err := http.ListenAndServe(metricsAddr, promhttp.HandlerFor(reg, promhttp.HandlerOpts{})); err != nil {
+		if err := http.ListenAndServe(metricsAddr, promhttp.HandlerFor(reg, promhttp.HandlerOpts{EnableOpenMetrics: true})); err != nil {
 			log.Panicf("error while serving metrics: %s", err)
 		}
 	}()
@@ -7,6 +7,7 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	prommiddleware "github.com/slok/go-prometheus-middleware"
 )
@@ -51,7 +52,7 @@ func main() {
 	// Serve our metrics.
 	go func() {
 		log.Printf("metrics listening at %s", metricsAddr)
-		if err := http.ListenAndServe(metricsAddr, promhttp.Handler()); err != nil {
+		if err := http.ListenAndServe(metricsAddr, promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})); err != nil {
 			log.Panicf("error while serving metrics: %s", err)
 		}
 	}()
@@ -8,6 +8,7 @@ import (
 	"syscall"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	prommiddleware "github.com/slok/go-prometheus-middleware"
 	promgin "github.com/slok/go-prometheus-middleware/gin"
@@ -25,16 +26,19 @@ func main() {
 	// Create our gin instance.
 	r := gin.New()
 
-	// Add the middlewares to all gin routes.
-	r.Use(
-		promgin.Handler("", mdlw),
-		gin.Logger(),
-	)
+	// Measure all gin routes using the route templates as the handler IDs.
+	if err := promgin.Instrument(r, mdlw); err != nil {
+		log.Panicf("error while instrumenting gin: %s", err)
+	}
+	r.Use(gin.Logger())
 
-	// Add our handler
+	// Add our handlers
 	r.GET("/", func(c *gin.Context) {
 		c.String(http.StatusOK, "Hello world!")
 	})
+	r.GET("/users/:id", func(c *gin.Context) {
+		c.String(http.StatusOK, "Hello %s!", c.Param("id"))
+	})
 
 	// Serve our handler.
 	go func() {
@@ -47,7 +51,7 @@ func main() {
 	// Serve our metrics.
 	go func() {
 		log.Printf("metrics listening at %s", metricsAddr)
-		if err := http.ListenAndServe(metricsAddr, promhttp.Handler()); err != nil {
+		if err := http.ListenAndServe(metricsAddr, promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})); err != nil {
 			log.Panicf("error while serving metrics: %s", err)
 		}
 	}()
@@ -7,7 +7,8 @@ import (
 	"os/signal"
 	"syscall"
 
-	gorestful "github.com/emicklei/go-restful"
+	gorestful "github.com/emicklei/go-restful/v3"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	prommiddleware "github.com/slok/go-prometheus-middleware"
 	promgorestful "github.com/slok/go-prometheus-middleware/gorestful"
@@ -25,16 +26,20 @@ func main() {
 	// Create our gorestful instance.
 	c := gorestful.NewContainer()
 
-	// Add the middleware for all routes.
+	// Add the middleware for all routes, the requests will be measured using the
+	// route paths as the handler IDs (e.g `/users/{id}`).
 	c.Filter(promgorestful.Handler("", mdlw))
 
-	// Add our handler.
+	// Add our handlers.
 	ws := &gorestful.WebService{}
 	ws.Produces(gorestful.MIME_JSON)
 
 	ws.Route(ws.GET("/").To(func(_ *gorestful.Request, resp *gorestful.Response) {
 		resp.WriteEntity("Hello world")
 	}))
+	ws.Route(ws.GET("/users/{id}").To(func(req *gorestful.Request, resp *gorestful.Response) {
+		resp.WriteEntity("Hello " + req.PathParameter("id"))
+	}))
 	c.Add(ws)
 
 	// Serve our handler.
@@ -48,7 +53,7 @@ func main() {
 	// Serve our metrics.
 	go func() {
 		log.Printf("metrics listening at %s", metricsAddr)
-		if err := http.ListenAndServe(metricsAddr, promhttp.Handler()); err != nil {
+		if err := http.ListenAndServe(metricsAddr, promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})); err != nil {
 			log.Panicf("error while serving metrics: %s", err)
 		}
 	}()
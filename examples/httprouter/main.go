@@ -8,6 +8,7 @@ import (
 	"syscall"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	prommiddleware "github.com/slok/go-prometheus-middleware"
 	promhttprouter "github.com/slok/go-prometheus-middleware/httprouter"
@@ -39,13 +40,14 @@ func main() {
 		w.Write([]byte("test2 " + id))
 	}
 
-	// Create our router.
-	r := httprouter.New()
+	// Create our instrumented router, the routes will be measured using
+	// the route patterns as the handler IDs.
+	r := promhttprouter.NewRouter(mdlw)
 
-	// Add the middleware to each route.
-	r.GET("/", promhttprouter.Handler("/", h, mdlw))
-	r.GET("/test/:id", promhttprouter.Handler("/test/:id", h1, mdlw))
-	r.GET("/test2/:id", promhttprouter.Handler("/test2/:id", h2, mdlw))
+	// Add our routes.
+	r.GET("/", h)
+	r.GET("/test/:id", h1)
+	r.GET("/test2/:id", h2)
 
 	// Serve our handler.
 	go func() {
@@ -58,7 +60,7 @@ func main() {
 	// Serve our metrics.
 	go func() {
 		log.Printf("metrics listening at %s", metricsAddr)
-		if err := http.ListenAndServe(metricsAddr, promhttp.Handler()); err != nil {
+		if err := http.ListenAndServe(metricsAddr, promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})); err != nil {
 			log.Panicf("error while serving metrics: %s", err)
 		}
 	}()
@@ -37,3 +37,34 @@ func Example_ginMiddleware() {
 		log.Panicf("error while serving: %s", err)
 	}
 }
+
+// Instrument shows how you would measure all the routes of a gin engine using the
+// gin route templates as the handler IDs.
+func Example_instrument() {
+	// Create our middleware factory with the default settings.
+	mdlw := prommiddleware.NewDefault()
+
+	// Create our gin instance and instrument it before adding the routes.
+	r := gin.New()
+	if err := promgin.Instrument(r, mdlw); err != nil {
+		log.Panicf("error while instrumenting gin: %s", err)
+	}
+
+	// Add our handlers, they will be measured with `/` and `/users/:id` handler IDs.
+	r.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, "Hello world!")
+	})
+	r.GET("/users/:id", func(c *gin.Context) {
+		c.String(http.StatusOK, "Hello %s!", c.Param("id"))
+	})
+
+	// Serve metrics from the default prometheus registry.
+	log.Printf("serving metrics at: %s", ":8081")
+	go http.ListenAndServe(":8081", promhttp.Handler())
+
+	// Serve our handler.
+	log.Printf("listening at: %s", ":8080")
+	if err := r.Run(":8080"); err != nil {
+		log.Panicf("error while serving: %s", err)
+	}
+}
@@ -4,15 +4,27 @@
 package gin
 
 import (
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
 	prommiddleware "github.com/slok/go-prometheus-middleware"
 )
 
+// NoRouteHandlerID is the handler ID used for the requests that don't match any gin route
+// (e.g 404s) when the handler ID is inferred from the route, this way the requests of
+// unknown paths don't create new metric series.
+// Gin writes its default 404 and 405 responses after the middlewares return, so without
+// NoRoute and NoMethod handlers writing the response, the response size of these requests
+// is measured as 0. Instrument sets handlers that write the gin default responses.
+const NoRouteHandlerID = "no_route"
+
 // Handler returns a gin compatible middleware from a Middleware factory instance.
-// The first handlerID argument is the same argument passed on Middleware.Handler method.
+// The first handlerID argument is the same argument passed on Middleware.Handler method,
+// if empty, the handler ID will be the template of the gin route that matched the request
+// (e.g `/users/:id`) or NoRouteHandlerID if none matched.
 func Handler(handlerID string, m prommiddleware.Middleware) gin.HandlerFunc {
 	return gin.HandlerFunc(func(ctx *gin.Context) {
 		// Create a dummy handler to wrap the middleware chain of gin, this way Middleware
@@ -21,6 +33,104 @@ func Handler(handlerID string, m prommiddleware.Middleware) gin.HandlerFunc {
 			ctx.Next()
 		})
 
-		m.Handler(handlerID, dh).ServeHTTP(ctx.Writer, ctx.Request)
+		hid := handlerID
+		if hid == "" {
+			hid = ctx.FullPath()
+			if hid == "" {
+				hid = NoRouteHandlerID
+			}
+		}
+
+		// The gin chain writes on the gin writer instead of the writer received by the
+		// dummy handler, so the middleware needs to get the response data from the gin writer,
+		// we wrap it to know when the first byte of the response is written.
+		rr := &responseReporter{ResponseWriter: ctx.Writer}
+		ctx.Writer = rr
+		defer func() { ctx.Writer = rr.ResponseWriter }()
+
+		m.Handler(hid, dh).ServeHTTP(rr, ctx.Request)
 	})
 }
+
+// Instrument installs the middleware on the gin engine so all the routes (and the
+// unmatched requests) are measured using the gin route templates as the handler IDs.
+// Gin only applies the middlewares to the routes registered after them, so it needs to
+// be called before registering the routes, otherwise it returns an error.
+// It also sets the NoRoute and NoMethod handlers of the engine to write the gin default
+// responses inside the measured chain, set your own handlers after calling it.
+func Instrument(e *gin.Engine, m prommiddleware.Middleware) error {
+	if routes := e.Routes(); len(routes) > 0 {
+		return fmt.Errorf("the engine already has %d routes that would not be measured, instrument it before registering the routes", len(routes))
+	}
+
+	e.Use(Handler("", m))
+	e.NoRoute(defaultResponse(http.StatusNotFound, "404 page not found"))
+	e.NoMethod(defaultResponse(http.StatusMethodNotAllowed, "405 method not allowed"))
+
+	return nil
+}
+
+// defaultResponse returns a handler that writes the gin default response of the status code.
+func defaultResponse(code int, body string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.Data(code, gin.MIMEPlain, []byte(body))
+	}
+}
+
+// responseReporter reports the response data of the gin writer to the middleware.
+type responseReporter struct {
+	gin.ResponseWriter
+	firstByteAt time.Time
+}
+
+func (r *responseReporter) WriteHeaderNow() {
+	r.recordFirstByte()
+	r.ResponseWriter.WriteHeaderNow()
+}
+
+func (r *responseReporter) Write(data []byte) (int, error) {
+	r.recordFirstByte()
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *responseReporter) WriteString(s string) (int, error) {
+	r.recordFirstByte()
+	return r.ResponseWriter.WriteString(s)
+}
+
+func (r *responseReporter) Flush() {
+	r.recordFirstByte()
+	r.ResponseWriter.Flush()
+}
+
+// Unwrap returns the gin writer so http.ResponseController can reach its features.
+func (r *responseReporter) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// recordFirstByte records the moment when the headers of the response are sent.
+func (r *responseReporter) recordFirstByte() {
+	if r.firstByteAt.IsZero() {
+		r.firstByteAt = time.Now()
+	}
+}
+
+func (r *responseReporter) StatusCode() int {
+	return r.Status()
+}
+
+func (r *responseReporter) BytesWritten() int64 {
+	// Gin returns a negative size when nothing has been written.
+	if size := r.Size(); size > 0 {
+		return int64(size)
+	}
+	return 0
+}
+
+func (r *responseReporter) WroteHeader() bool {
+	return r.Written()
+}
+
+func (r *responseReporter) FirstByteAt() time.Time {
+	return r.firstByteAt
+}
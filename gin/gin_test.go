@@ -0,0 +1,232 @@
+package gin_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+
+	prommiddleware "github.com/slok/go-prometheus-middleware"
+	promgin "github.com/slok/go-prometheus-middleware/gin"
+)
+
+func getMetrics(reg prometheus.Gatherer) string {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(rec, req)
+	body, _ := ioutil.ReadAll(rec.Result().Body)
+	return string(body)
+}
+
+func TestHandlerStatusCode(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	tests := []struct {
+		name    string
+		handler gin.HandlerFunc
+		expCode string
+		expSize int
+	}{
+		{
+			name:    "A handler that doesn't write should be measured with the implicit status code.",
+			handler: func(c *gin.Context) {},
+			expCode: "200",
+			expSize: 0,
+		},
+		{
+			name: "A handler that writes without status code should be measured with the implicit status code.",
+			handler: func(c *gin.Context) {
+				c.Writer.Write([]byte("test"))
+			},
+			expCode: "200",
+			expSize: 4,
+		},
+		{
+			name: "A handler that writes a status code should be measured with the status code.",
+			handler: func(c *gin.Context) {
+				c.String(http.StatusNotFound, "not found")
+			},
+			expCode: "404",
+			expSize: 9,
+		},
+		{
+			name: "A handler that only sets the status code should be measured with the status code.",
+			handler: func(c *gin.Context) {
+				c.Status(http.StatusNoContent)
+			},
+			expCode: "204",
+			expSize: 0,
+		},
+		{
+			name: "A handler that aborts with an error should be measured with the error status code.",
+			handler: func(c *gin.Context) {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "test"})
+			},
+			expCode: "500",
+			expSize: 16,
+		},
+		{
+			name: "A handler that writes the status code multiple times should be measured with the first one.",
+			handler: func(c *gin.Context) {
+				c.String(http.StatusCreated, "test")
+				c.Status(http.StatusInternalServerError)
+			},
+			expCode: "201",
+			expSize: 4,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			mdlw := prommiddleware.New(prommiddleware.Config{}, reg)
+
+			e := gin.New()
+			e.Use(promgin.Handler("test", mdlw))
+			e.GET("/test", test.handler)
+			e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+
+			metrics := getMetrics(reg)
+			expMetric := fmt.Sprintf(`http_request_duration_seconds_count{code=%q,handler="test",method="GET"} 1`, test.expCode)
+			assert.Contains(t, metrics, expMetric)
+			expSizeMetric := fmt.Sprintf(`http_response_size_bytes_sum{code=%q,handler="test",method="GET"} %d`, test.expCode, test.expSize)
+			assert.Contains(t, metrics, expSizeMetric)
+		})
+	}
+}
+
+func TestHandlerTimeToFirstByte(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	t.Run("A streaming handler should measure the time to first byte until the headers are sent.", func(t *testing.T) {
+		assert := assert.New(t)
+
+		reg := prometheus.NewRegistry()
+		mdlw := prommiddleware.New(prommiddleware.Config{}, reg)
+
+		e := gin.New()
+		e.Use(promgin.Handler("test", mdlw))
+		e.GET("/test", func(c *gin.Context) {
+			c.String(http.StatusOK, "test")
+			c.Writer.Flush()
+			time.Sleep(150 * time.Millisecond)
+		})
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+
+		metrics := getMetrics(reg)
+		assert.Contains(metrics, `http_request_ttfb_seconds_bucket{code="200",handler="test",method="GET",le="0.1"} 1`)
+		assert.Contains(metrics, `http_request_duration_seconds_bucket{code="200",handler="test",method="GET",le="0.1"} 0`)
+	})
+}
+
+func TestHandlerHandlerID(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	tests := []struct {
+		name      string
+		handlerID string
+		path      string
+		expMetric string
+	}{
+		{
+			name:      "A predefined handler ID should be used as the handler ID.",
+			handlerID: "test",
+			path:      "/users/42",
+			expMetric: `http_request_duration_seconds_count{code="200",handler="test",method="GET"} 1`,
+		},
+		{
+			name:      "Without handler ID the gin route template should be used as the handler ID.",
+			handlerID: "",
+			path:      "/users/42",
+			expMetric: `http_request_duration_seconds_count{code="200",handler="/users/:id",method="GET"} 1`,
+		},
+		{
+			name:      "Without handler ID the unmatched requests should use the no route handler ID.",
+			handlerID: "",
+			path:      "/wp-admin/install.php",
+			expMetric: `http_request_duration_seconds_count{code="404",handler="no_route",method="GET"} 1`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			mdlw := prommiddleware.New(prommiddleware.Config{}, reg)
+
+			e := gin.New()
+			e.Use(promgin.Handler(test.handlerID, mdlw))
+			e.GET("/users/:id", func(c *gin.Context) { c.String(http.StatusOK, c.Param("id")) })
+			e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", test.path, nil))
+
+			assert.Contains(t, getMetrics(reg), test.expMetric)
+		})
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	t.Run("Instrumenting an engine should measure all the routes with the route templates.", func(t *testing.T) {
+		assert := assert.New(t)
+
+		reg := prometheus.NewRegistry()
+		mdlw := prommiddleware.New(prommiddleware.Config{}, reg)
+
+		e := gin.New()
+		e.HandleMethodNotAllowed = true
+		assert.NoError(promgin.Instrument(e, mdlw))
+		e.GET("/users/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+		e.POST("/users", func(c *gin.Context) { c.Status(http.StatusCreated) })
+
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/42", nil))
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/43", nil))
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/users", nil))
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/users", nil))
+
+		// The unmatched requests should get and measure the gin default response.
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest("GET", "/unknown", nil))
+		assert.Equal(http.StatusNotFound, rec.Code)
+		assert.Equal("404 page not found", rec.Body.String())
+
+		metrics := getMetrics(reg)
+		assert.Contains(metrics, `http_request_duration_seconds_count{code="200",handler="/users/:id",method="GET"} 2`)
+		assert.Contains(metrics, `http_request_duration_seconds_count{code="201",handler="/users",method="POST"} 1`)
+		assert.Contains(metrics, `http_request_duration_seconds_count{code="404",handler="no_route",method="GET"} 1`)
+		assert.Contains(metrics, `http_response_size_bytes_sum{code="404",handler="no_route",method="GET"} 18`)
+		assert.Contains(metrics, `http_response_size_bytes_sum{code="405",handler="no_route",method="DELETE"} 22`)
+	})
+
+	t.Run("Instrumenting an engine should measure the custom no route handlers.", func(t *testing.T) {
+		assert := assert.New(t)
+
+		reg := prometheus.NewRegistry()
+		mdlw := prommiddleware.New(prommiddleware.Config{}, reg)
+
+		e := gin.New()
+		assert.NoError(promgin.Instrument(e, mdlw))
+		e.NoRoute(func(c *gin.Context) { c.String(http.StatusNotFound, "not found") })
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest("GET", "/unknown", nil))
+		assert.Equal("not found", rec.Body.String())
+
+		assert.Contains(getMetrics(reg), `http_response_size_bytes_sum{code="404",handler="no_route",method="GET"} 9`)
+	})
+
+	t.Run("Instrumenting an engine with registered routes should fail.", func(t *testing.T) {
+		mdlw := prommiddleware.New(prommiddleware.Config{}, prometheus.NewRegistry())
+
+		e := gin.New()
+		e.GET("/users/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+		assert.Error(t, promgin.Instrument(e, mdlw))
+	})
+}
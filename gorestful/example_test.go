@@ -4,7 +4,7 @@ import (
 	"log"
 	"net/http"
 
-	gorestful "github.com/emicklei/go-restful"
+	gorestful "github.com/emicklei/go-restful/v3"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	prommiddleware "github.com/slok/go-prometheus-middleware"
 	promgorestful "github.com/slok/go-prometheus-middleware/gorestful"
@@ -39,3 +39,32 @@ func Example_gorestfulMiddleware() {
 		log.Panicf("error while serving: %s", err)
 	}
 }
+
+// Instrument shows how you would measure all the routes of the web services of a
+// Gorestful container using the route operation names as the handler IDs.
+func Example_instrument() {
+	// Create our middleware factory with the default settings.
+	mdlw := prommiddleware.NewDefault()
+
+	// Create our gorestful instance with our web services.
+	c := gorestful.NewContainer()
+	ws := &gorestful.WebService{}
+	ws.Path("/users")
+	ws.Route(ws.GET("/{id}").Operation("findUser").To(func(req *gorestful.Request, resp *gorestful.Response) {
+		resp.WriteEntity("Hello " + req.PathParameter("id"))
+	}))
+	c.Add(ws)
+
+	// Add the middleware to all the web services.
+	promgorestful.Instrument(c, promgorestful.OperationHandler(mdlw))
+
+	// Serve metrics from the default prometheus registry.
+	log.Printf("serving metrics at: %s", ":8081")
+	go http.ListenAndServe(":8081", promhttp.Handler())
+
+	// Serve our handler.
+	log.Printf("listening at: %s", ":8080")
+	if err := http.ListenAndServe(":8080", c); err != nil {
+		log.Panicf("error while serving: %s", err)
+	}
+}
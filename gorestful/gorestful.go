@@ -6,14 +6,53 @@ package gorestful
 import (
 	"net/http"
 
-	gorestful "github.com/emicklei/go-restful"
+	gorestful "github.com/emicklei/go-restful/v3"
 
 	prommiddleware "github.com/slok/go-prometheus-middleware"
 )
 
+// NoRouteHandlerID is the handler ID used for the requests that don't match any route
+// (e.g 404s on container filters) when the handler ID is inferred from the route, this
+// way the requests of unknown paths don't create new metric series.
+const NoRouteHandlerID = "no_route"
+
 // Handler returns a gorestful compatible middleware from a Middleware factory instance.
-// The first handlerID argument is the same argument passed on Middleware.Handler method.
+// The first handlerID argument is the same argument passed on Middleware.Handler method,
+// if empty, the handler ID will be the path of the route that matched the request (e.g
+// `/users/{id}`) or NoRouteHandlerID if none matched.
 func Handler(handlerID string, m prommiddleware.Middleware) gorestful.FilterFunction {
+	return handler(m, func(req *gorestful.Request) string {
+		if handlerID != "" {
+			return handlerID
+		}
+		return routePath(req)
+	})
+}
+
+// OperationHandler returns a gorestful compatible middleware from a Middleware factory
+// instance that uses the operation name of the route that matched the request as the
+// handler ID (e.g `findUser`). Gorestful sets the name of the route function as the
+// operation name when the route doesn't set one.
+func OperationHandler(m prommiddleware.Middleware) gorestful.FilterFunction {
+	return handler(m, func(req *gorestful.Request) string {
+		if route := req.SelectedRoute(); route != nil && route.Operation() != "" {
+			return route.Operation()
+		}
+		return routePath(req)
+	})
+}
+
+// Instrument installs the filter (e.g Handler or OperationHandler) on all the web services
+// registered on the container. The web services filters only run on the requests that
+// match a route, to measure also the unmatched requests, use the filter as a container
+// filter instead.
+func Instrument(c *gorestful.Container, filter gorestful.FilterFunction) {
+	for _, ws := range c.RegisteredWebServices() {
+		ws.Filter(filter)
+	}
+}
+
+func handler(m prommiddleware.Middleware, handlerID func(req *gorestful.Request) string) gorestful.FilterFunction {
 	// Create a dummy handler to wrap the middleware chain of gorestful, this way Middleware
 	// interface can wrap the gorestful chain.
 	return func(req *gorestful.Request, resp *gorestful.Response, chain *gorestful.FilterChain) {
@@ -23,6 +62,14 @@ func Handler(handlerID string, m prommiddleware.Middleware) gorestful.FilterFunc
 			chain.ProcessFilter(req, resp)
 		})
 
-		m.Handler(handlerID, h).ServeHTTP(resp.ResponseWriter, req.Request)
+		m.Handler(handlerID(req), h).ServeHTTP(resp.ResponseWriter, req.Request)
+	}
+}
+
+// routePath returns the path of the route that matched the request.
+func routePath(req *gorestful.Request) string {
+	if path := req.SelectedRoutePath(); path != "" {
+		return path
 	}
+	return NoRouteHandlerID
 }
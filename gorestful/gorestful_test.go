@@ -0,0 +1,176 @@
+package gorestful_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	gorestful "github.com/emicklei/go-restful/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+
+	prommiddleware "github.com/slok/go-prometheus-middleware"
+	promgorestful "github.com/slok/go-prometheus-middleware/gorestful"
+)
+
+func getMetrics(reg prometheus.Gatherer) string {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(rec, req)
+	body, _ := ioutil.ReadAll(rec.Result().Body)
+	return string(body)
+}
+
+func TestHandlerStatusCode(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler gorestful.RouteFunction
+		expCode string
+	}{
+		{
+			name:    "A handler that doesn't write should be measured with the implicit status code.",
+			handler: func(req *gorestful.Request, resp *gorestful.Response) {},
+			expCode: "200",
+		},
+		{
+			name: "A handler that writes without status code should be measured with the implicit status code.",
+			handler: func(req *gorestful.Request, resp *gorestful.Response) {
+				resp.Write([]byte("test"))
+			},
+			expCode: "200",
+		},
+		{
+			name: "A handler that writes a status code should be measured with the status code.",
+			handler: func(req *gorestful.Request, resp *gorestful.Response) {
+				resp.WriteErrorString(http.StatusNotFound, "not found")
+			},
+			expCode: "404",
+		},
+		{
+			name: "A handler that writes the status code multiple times should be measured with the first one.",
+			handler: func(req *gorestful.Request, resp *gorestful.Response) {
+				resp.WriteHeader(http.StatusCreated)
+				resp.WriteHeader(http.StatusInternalServerError)
+			},
+			expCode: "201",
+		},
+		{
+			name: "A handler that writes informational status codes should be measured with the final status code.",
+			handler: func(req *gorestful.Request, resp *gorestful.Response) {
+				resp.WriteHeader(http.StatusEarlyHints)
+				resp.WriteHeader(http.StatusAccepted)
+			},
+			expCode: "202",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			mdlw := prommiddleware.New(prommiddleware.Config{}, reg)
+
+			c := gorestful.NewContainer()
+			ws := &gorestful.WebService{}
+			ws.Filter(promgorestful.Handler("test", mdlw))
+			ws.Route(ws.GET("/test").To(test.handler))
+			c.Add(ws)
+			c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+
+			expMetric := fmt.Sprintf(`http_request_duration_seconds_count{code=%q,handler="test",method="GET"} 1`, test.expCode)
+			assert.Contains(t, getMetrics(reg), expMetric)
+		})
+	}
+}
+
+func TestHandlerHandlerID(t *testing.T) {
+	tests := []struct {
+		name      string
+		filter    func(m prommiddleware.Middleware) gorestful.FilterFunction
+		container bool
+		path      string
+		expMetric string
+	}{
+		{
+			name:      "A predefined handler ID should be used as the handler ID.",
+			filter:    func(m prommiddleware.Middleware) gorestful.FilterFunction { return promgorestful.Handler("test", m) },
+			path:      "/users/42",
+			expMetric: `http_request_duration_seconds_count{code="200",handler="test",method="GET"} 1`,
+		},
+		{
+			name:      "Without handler ID the route path should be used as the handler ID.",
+			filter:    func(m prommiddleware.Middleware) gorestful.FilterFunction { return promgorestful.Handler("", m) },
+			path:      "/users/42",
+			expMetric: `http_request_duration_seconds_count{code="200",handler="/users/{id}",method="GET"} 1`,
+		},
+		{
+			name:      "Without handler ID on a container filter the unmatched requests should use the no route handler ID.",
+			filter:    func(m prommiddleware.Middleware) gorestful.FilterFunction { return promgorestful.Handler("", m) },
+			container: true,
+			path:      "/wp-admin/install.php",
+			expMetric: `http_request_duration_seconds_count{code="404",handler="no_route",method="GET"} 1`,
+		},
+		{
+			name:      "The operation handler should use the route operation as the handler ID.",
+			filter:    promgorestful.OperationHandler,
+			path:      "/users/42",
+			expMetric: `http_request_duration_seconds_count{code="200",handler="findUser",method="GET"} 1`,
+		},
+		{
+			name:      "The operation handler on a container filter should use the no route handler ID for the unmatched requests.",
+			filter:    promgorestful.OperationHandler,
+			container: true,
+			path:      "/wp-admin/install.php",
+			expMetric: `http_request_duration_seconds_count{code="404",handler="no_route",method="GET"} 1`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			mdlw := prommiddleware.New(prommiddleware.Config{}, reg)
+
+			c := gorestful.NewContainer()
+			ws := &gorestful.WebService{}
+			ws.Route(ws.GET("/users/{id}").Operation("findUser").To(func(req *gorestful.Request, resp *gorestful.Response) {}))
+			if test.container {
+				c.Filter(test.filter(mdlw))
+			} else {
+				ws.Filter(test.filter(mdlw))
+			}
+			c.Add(ws)
+			c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", test.path, nil))
+
+			assert.Contains(t, getMetrics(reg), test.expMetric)
+		})
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	assert := assert.New(t)
+
+	reg := prometheus.NewRegistry()
+	mdlw := prommiddleware.New(prommiddleware.Config{}, reg)
+
+	c := gorestful.NewContainer()
+	users := &gorestful.WebService{}
+	users.Path("/users")
+	users.Route(users.GET("/{id}").To(func(req *gorestful.Request, resp *gorestful.Response) {}))
+	c.Add(users)
+	teams := &gorestful.WebService{}
+	teams.Path("/teams")
+	teams.Route(teams.POST("/{id}/members").To(func(req *gorestful.Request, resp *gorestful.Response) { resp.WriteHeader(http.StatusCreated) }))
+	c.Add(teams)
+
+	promgorestful.Instrument(c, promgorestful.Handler("", mdlw))
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/42", nil))
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/43", nil))
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/teams/1/members", nil))
+
+	metrics := getMetrics(reg)
+	assert.Contains(metrics, `http_request_duration_seconds_count{code="200",handler="/users/{id}",method="GET"} 2`)
+	assert.Contains(metrics, `http_request_duration_seconds_count{code="201",handler="/teams/{id}/members",method="POST"} 1`)
+}
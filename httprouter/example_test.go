@@ -73,3 +73,34 @@ func Example_httprouterMiddlewareOnRouter() {
 		log.Panicf("error while serving: %s", err)
 	}
 }
+
+// HTTPRouterInstrumentedRouter shows how you would create a default middleware factory
+// and use it to create an instrumented httprouter Router that measures all the routes
+// using the route patterns as the handler IDs.
+func Example_httprouterInstrumentedRouter() {
+	// Create our handler.
+	myHandler := func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		id := p.ByName("id")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello world! " + id))
+	}
+
+	// Create our middleware factory with the default settings.
+	mdlw := prommiddleware.NewDefault()
+
+	// Create our instrumented router and add the routes, they will be measured
+	// with `/test/:id` and `/test2/:id` handler IDs.
+	r := promhttprouter.NewRouter(mdlw)
+	r.GET("/test/:id", myHandler)
+	r.GET("/test2/:id", myHandler)
+
+	// Serve metrics from the default prometheus registry.
+	log.Printf("serving metrics at: %s", ":8081")
+	go http.ListenAndServe(":8081", promhttp.Handler())
+
+	// Serve our handler.
+	log.Printf("listening at: %s", ":8080")
+	if err := http.ListenAndServe(":8080", r); err != nil {
+		log.Panicf("error while serving: %s", err)
+	}
+}
@@ -24,3 +24,127 @@ func Handler(handlerID string, next httprouter.Handle, m prommiddleware.Middlewa
 		m.Handler(handlerID, h).ServeHTTP(w, r)
 	}
 }
+
+const (
+	// NotFoundHandlerID is the handler ID used by the Router for the requests that
+	// don't match any route.
+	NotFoundHandlerID = "not_found"
+	// MethodNotAllowedHandlerID is the handler ID used by the Router for the requests
+	// that match a route of other methods.
+	MethodNotAllowedHandlerID = "method_not_allowed"
+)
+
+// Router is a httprouter.Router that measures all the routes registered on it using
+// the route pattern (e.g `/users/:id`) as the handler ID. The requests handled by the
+// NotFound and MethodNotAllowed handlers are measured with NotFoundHandlerID and
+// MethodNotAllowedHandlerID handler IDs.
+type Router struct {
+	*httprouter.Router
+
+	// NotFound is the handler called when no matching route is found, if it is not set,
+	// http.NotFound is used. It replaces the httprouter.Router NotFound handler so
+	// it can be measured.
+	NotFound http.Handler
+	// MethodNotAllowed is the handler called when a request cannot be routed and
+	// HandleMethodNotAllowed is true, if it is not set, http.Error with
+	// http.StatusMethodNotAllowed is used. It replaces the httprouter.Router
+	// MethodNotAllowed handler so it can be measured.
+	MethodNotAllowed http.Handler
+
+	m prommiddleware.Middleware
+}
+
+// NewRouter returns a new Router that measures the routes with the Middleware factory instance.
+func NewRouter(m prommiddleware.Middleware) *Router {
+	r := &Router{
+		Router: httprouter.New(),
+		m:      m,
+	}
+
+	r.Router.NotFound = m.Handler(NotFoundHandlerID, http.HandlerFunc(r.notFound))
+	r.Router.MethodNotAllowed = m.Handler(MethodNotAllowedHandlerID, http.HandlerFunc(r.methodNotAllowed))
+
+	return r
+}
+
+// GET is a shortcut for router.Handle(http.MethodGet, path, handle).
+func (r *Router) GET(path string, handle httprouter.Handle) {
+	r.Handle(http.MethodGet, path, handle)
+}
+
+// HEAD is a shortcut for router.Handle(http.MethodHead, path, handle).
+func (r *Router) HEAD(path string, handle httprouter.Handle) {
+	r.Handle(http.MethodHead, path, handle)
+}
+
+// OPTIONS is a shortcut for router.Handle(http.MethodOptions, path, handle).
+func (r *Router) OPTIONS(path string, handle httprouter.Handle) {
+	r.Handle(http.MethodOptions, path, handle)
+}
+
+// POST is a shortcut for router.Handle(http.MethodPost, path, handle).
+func (r *Router) POST(path string, handle httprouter.Handle) {
+	r.Handle(http.MethodPost, path, handle)
+}
+
+// PUT is a shortcut for router.Handle(http.MethodPut, path, handle).
+func (r *Router) PUT(path string, handle httprouter.Handle) {
+	r.Handle(http.MethodPut, path, handle)
+}
+
+// PATCH is a shortcut for router.Handle(http.MethodPatch, path, handle).
+func (r *Router) PATCH(path string, handle httprouter.Handle) {
+	r.Handle(http.MethodPatch, path, handle)
+}
+
+// DELETE is a shortcut for router.Handle(http.MethodDelete, path, handle).
+func (r *Router) DELETE(path string, handle httprouter.Handle) {
+	r.Handle(http.MethodDelete, path, handle)
+}
+
+// Handle registers a new measured request handle with the given path and method.
+func (r *Router) Handle(method, path string, handle httprouter.Handle) {
+	r.Router.Handle(method, path, Handler(path, handle, r.m))
+}
+
+// Handler registers a new measured http.Handler with the given path and method.
+// The Params are available in the request context under httprouter.ParamsKey.
+func (r *Router) Handler(method, path string, handler http.Handler) {
+	r.Router.Handler(method, path, r.m.Handler(path, handler))
+}
+
+// HandlerFunc registers a new measured http.HandlerFunc with the given path and method.
+func (r *Router) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	r.Handler(method, path, handler)
+}
+
+// ServeFiles serves files from the given file system root the same way as the
+// httprouter.Router ServeFiles, measuring the requests.
+func (r *Router) ServeFiles(path string, root http.FileSystem) {
+	if len(path) < 10 || path[len(path)-10:] != "/*filepath" {
+		panic("path must end with /*filepath in path '" + path + "'")
+	}
+
+	fileServer := http.FileServer(root)
+
+	r.GET(path, func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		req.URL.Path = ps.ByName("filepath")
+		fileServer.ServeHTTP(w, req)
+	})
+}
+
+func (r *Router) notFound(w http.ResponseWriter, req *http.Request) {
+	if r.NotFound != nil {
+		r.NotFound.ServeHTTP(w, req)
+		return
+	}
+	http.NotFound(w, req)
+}
+
+func (r *Router) methodNotAllowed(w http.ResponseWriter, req *http.Request) {
+	if r.MethodNotAllowed != nil {
+		r.MethodNotAllowed.ServeHTTP(w, req)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
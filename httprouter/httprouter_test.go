@@ -0,0 +1,223 @@
+package httprouter_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+
+	prommiddleware "github.com/slok/go-prometheus-middleware"
+	promhttprouter "github.com/slok/go-prometheus-middleware/httprouter"
+)
+
+func getMetrics(reg prometheus.Gatherer) string {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(rec, req)
+	body, _ := ioutil.ReadAll(rec.Result().Body)
+	return string(body)
+}
+
+func TestHandlerStatusCode(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler httprouter.Handle
+		expCode string
+	}{
+		{
+			name:    "A handler that doesn't write should be measured with the implicit status code.",
+			handler: func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {},
+			expCode: "200",
+		},
+		{
+			name: "A handler that writes without status code should be measured with the implicit status code.",
+			handler: func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+				w.Write([]byte("test"))
+			},
+			expCode: "200",
+		},
+		{
+			name: "A handler that writes a status code should be measured with the status code.",
+			handler: func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+				w.WriteHeader(http.StatusNotFound)
+			},
+			expCode: "404",
+		},
+		{
+			name: "A handler that writes the status code multiple times should be measured with the first one.",
+			handler: func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+				w.WriteHeader(http.StatusCreated)
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			expCode: "201",
+		},
+		{
+			name: "A handler that writes informational status codes should be measured with the final status code.",
+			handler: func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+				w.WriteHeader(http.StatusEarlyHints)
+				w.WriteHeader(http.StatusAccepted)
+			},
+			expCode: "202",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			mdlw := prommiddleware.New(prommiddleware.Config{}, reg)
+
+			r := httprouter.New()
+			r.GET("/test", promhttprouter.Handler("test", test.handler, mdlw))
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+
+			expMetric := fmt.Sprintf(`http_request_duration_seconds_count{code=%q,handler="test",method="GET"} 1`, test.expCode)
+			assert.Contains(t, getMetrics(reg), expMetric)
+		})
+	}
+}
+
+func TestRouter(t *testing.T) {
+	tests := []struct {
+		name       string
+		router     func(r *promhttprouter.Router)
+		method     string
+		path       string
+		expCode    int
+		expMetrics []string
+	}{
+		{
+			name: "A route registered with a method shortcut should be measured with the route pattern.",
+			router: func(r *promhttprouter.Router) {
+				r.GET("/users/:id", func(w http.ResponseWriter, _ *http.Request, p httprouter.Params) {
+					w.Write([]byte(p.ByName("id")))
+				})
+			},
+			method:  "GET",
+			path:    "/users/42",
+			expCode: http.StatusOK,
+			expMetrics: []string{
+				`http_request_duration_seconds_count{code="200",handler="/users/:id",method="GET"} 1`,
+			},
+		},
+		{
+			name: "A route registered with a custom method should be measured with the route pattern.",
+			router: func(r *promhttprouter.Router) {
+				r.Handle("PROPFIND", "/files/*path", func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+					w.WriteHeader(http.StatusMultiStatus)
+				})
+			},
+			method:  "PROPFIND",
+			path:    "/files/a/b",
+			expCode: http.StatusMultiStatus,
+			expMetrics: []string{
+				`http_request_duration_seconds_count{code="207",handler="/files/*path",method="other"} 1`,
+			},
+		},
+		{
+			name: "A route registered with a http.HandlerFunc should be measured with the route pattern and have the params.",
+			router: func(r *promhttprouter.Router) {
+				r.HandlerFunc("POST", "/users/:id/avatar", func(w http.ResponseWriter, r *http.Request) {
+					if httprouter.ParamsFromContext(r.Context()).ByName("id") != "42" {
+						w.WriteHeader(http.StatusBadRequest)
+						return
+					}
+					w.WriteHeader(http.StatusCreated)
+				})
+			},
+			method:  "POST",
+			path:    "/users/42/avatar",
+			expCode: http.StatusCreated,
+			expMetrics: []string{
+				`http_request_duration_seconds_count{code="201",handler="/users/:id/avatar",method="POST"} 1`,
+			},
+		},
+		{
+			name: "The served files should be measured with the route pattern.",
+			router: func(r *promhttprouter.Router) {
+				r.ServeFiles("/static/*filepath", http.Dir("."))
+			},
+			method:  "GET",
+			path:    "/static/httprouter.go",
+			expCode: http.StatusOK,
+			expMetrics: []string{
+				`http_request_duration_seconds_count{code="200",handler="/static/*filepath",method="GET"} 1`,
+			},
+		},
+		{
+			name: "An unmatched request should be measured with the not found handler ID.",
+			router: func(r *promhttprouter.Router) {
+				r.GET("/users/:id", func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {})
+			},
+			method:  "GET",
+			path:    "/wp-admin/install.php",
+			expCode: http.StatusNotFound,
+			expMetrics: []string{
+				`http_request_duration_seconds_count{code="404",handler="not_found",method="GET"} 1`,
+			},
+		},
+		{
+			name: "An unmatched request should be measured with the not found handler ID using the custom not found handler.",
+			router: func(r *promhttprouter.Router) {
+				r.NotFound = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusGone) })
+			},
+			method:  "GET",
+			path:    "/wp-admin/install.php",
+			expCode: http.StatusGone,
+			expMetrics: []string{
+				`http_request_duration_seconds_count{code="410",handler="not_found",method="GET"} 1`,
+			},
+		},
+		{
+			name: "A request with a not allowed method should be measured with the method not allowed handler ID.",
+			router: func(r *promhttprouter.Router) {
+				r.GET("/users/:id", func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {})
+			},
+			method:  "DELETE",
+			path:    "/users/42",
+			expCode: http.StatusMethodNotAllowed,
+			expMetrics: []string{
+				`http_request_duration_seconds_count{code="405",handler="method_not_allowed",method="DELETE"} 1`,
+			},
+		},
+		{
+			name: "A request with a not allowed method should be measured with the method not allowed handler ID using the custom handler.",
+			router: func(r *promhttprouter.Router) {
+				r.GET("/users/:id", func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {})
+				r.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusTeapot) })
+			},
+			method:  "DELETE",
+			path:    "/users/42",
+			expCode: http.StatusTeapot,
+			expMetrics: []string{
+				`http_request_duration_seconds_count{code="418",handler="method_not_allowed",method="DELETE"} 1`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			reg := prometheus.NewRegistry()
+			mdlw := prommiddleware.New(prommiddleware.Config{}, reg)
+
+			r := promhttprouter.NewRouter(mdlw)
+			test.router(r)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+			assert.Equal(test.expCode, w.Code)
+
+			metrics := getMetrics(reg)
+			for _, expMetric := range test.expMetrics {
+				assert.Contains(metrics, expMetric)
+			}
+		})
+	}
+}
@@ -0,0 +1,460 @@
+package middleware
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ResponseReporter can be implemented by the http.ResponseWriter received by the middleware
+// handler to report the status code and the size of the response. The middleware uses the
+// reported data instead of the intercepted one, this is required when the wrapped handler
+// doesn't write on the writer received from the middleware, e.g the framework adapters where
+// the handlers write on the framework response writer.
+type ResponseReporter interface {
+	// StatusCode returns the status code of the response.
+	StatusCode() int
+	// BytesWritten returns the number of bytes written on the response body.
+	BytesWritten() int64
+	// WroteHeader returns true if the response headers have already been written.
+	WroteHeader() bool
+}
+
+// FirstByteReporter can be implemented by a ResponseReporter to report when the first byte
+// of the response was written. Without it, the middleware can't know when the reported
+// response started and measures the time to first byte as the request duration.
+type FirstByteReporter interface {
+	// FirstByteAt returns when the first byte of the response was written, zero if
+	// nothing has been written.
+	FirstByteAt() time.Time
+}
+
+// responseWriterInterceptor is a simple wrapper to incercept set data on a
+// ResponseWriter.
+type responseWriterInterceptor struct {
+	http.ResponseWriter
+	statusCode   int
+	bytesWritten int64
+	wroteHeader  bool
+	firstByteAt  time.Time
+	reporter     ResponseReporter
+}
+
+// newResponseWriterInterceptor returns a new interceptor of the writer, if the writer
+// reports the response data, the reported data is used instead of the intercepted one.
+func newResponseWriterInterceptor(w http.ResponseWriter) *responseWriterInterceptor {
+	reporter, _ := w.(ResponseReporter)
+	return &responseWriterInterceptor{
+		statusCode:     http.StatusOK,
+		ResponseWriter: w,
+		reporter:       reporter,
+	}
+}
+
+// status returns the status code of the response.
+func (w *responseWriterInterceptor) status() int {
+	if w.reporter != nil {
+		return w.reporter.StatusCode()
+	}
+	return w.statusCode
+}
+
+// size returns the number of bytes written on the response body.
+func (w *responseWriterInterceptor) size() int64 {
+	if w.reporter != nil {
+		return w.reporter.BytesWritten()
+	}
+	return w.bytesWritten
+}
+
+// firstByte returns when the first byte of the response was written, zero if
+// nothing has been written.
+func (w *responseWriterInterceptor) firstByte() time.Time {
+	if fbr, ok := w.reporter.(FirstByteReporter); ok {
+		if at := fbr.FirstByteAt(); !at.IsZero() {
+			return at
+		}
+	}
+	return w.firstByteAt
+}
+
+// headerWritten returns true if the response headers have already been written.
+func (w *responseWriterInterceptor) headerWritten() bool {
+	if w.reporter != nil {
+		return w.reporter.WroteHeader()
+	}
+	return w.wroteHeader
+}
+
+func (w *responseWriterInterceptor) WriteHeader(statusCode int) {
+	w.recordFirstByte()
+	w.recordStatus(statusCode)
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *responseWriterInterceptor) Write(p []byte) (int, error) {
+	// Writing without headers sends the headers implicitly with a 200.
+	w.recordFirstByte()
+	w.recordStatus(http.StatusOK)
+	n, err := w.ResponseWriter.Write(p)
+	w.bytesWritten += int64(n)
+	return n, err
+}
+
+// Unwrap returns the wrapped writer so http.ResponseController can reach the
+// features of the original writer (e.g deadlines, full duplex).
+func (w *responseWriterInterceptor) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// recordFirstByte records the moment when the first byte of the response
+// (informational headers included) is sent to the client.
+func (w *responseWriterInterceptor) recordFirstByte() {
+	if w.firstByteAt.IsZero() {
+		w.firstByteAt = time.Now()
+	}
+}
+
+// recordStatus records the status code only if it's the first final status code sent,
+// the superfluous status codes are ignored because they are not sent to the client.
+// The informational status codes (1xx) are not final except the switching protocols
+// one (101).
+func (w *responseWriterInterceptor) recordStatus(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+
+	if statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols {
+		return
+	}
+
+	w.statusCode = statusCode
+	w.wroteHeader = true
+}
+
+// Optional interfaces that a http.ResponseWriter can implement.
+const (
+	closeNotifier = 1 << iota
+	flusher
+	hijacker
+	readerFrom
+	pusher
+)
+
+type closeNotifierDelegator struct{ *responseWriterInterceptor }
+type flusherDelegator struct{ *responseWriterInterceptor }
+type hijackerDelegator struct{ *responseWriterInterceptor }
+type readerFromDelegator struct{ *responseWriterInterceptor }
+type pusherDelegator struct{ *responseWriterInterceptor }
+
+func (d closeNotifierDelegator) CloseNotify() <-chan bool {
+	return d.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+func (d flusherDelegator) Flush() {
+	// Flushing without headers sends the headers implicitly with a 200.
+	d.recordFirstByte()
+	d.recordStatus(http.StatusOK)
+	d.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (d hijackerDelegator) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return d.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+func (d readerFromDelegator) ReadFrom(r io.Reader) (int64, error) {
+	// Writing without headers sends the headers implicitly with a 200.
+	d.recordFirstByte()
+	d.recordStatus(http.StatusOK)
+	n, err := d.ResponseWriter.(io.ReaderFrom).ReadFrom(r)
+	d.bytesWritten += n
+	return n, err
+}
+
+func (d pusherDelegator) Push(target string, opts *http.PushOptions) error {
+	return d.ResponseWriter.(http.Pusher).Push(target, opts)
+}
+
+// pickDelegator has all the combinations of the optional interfaces, indexed
+// by the bitmask of the interfaces implemented by the wrapped writer.
+var pickDelegator [32]func(*responseWriterInterceptor) http.ResponseWriter
+
+func init() {
+	pickDelegator[0] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return w
+	}
+	pickDelegator[closeNotifier] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.CloseNotifier
+		}{w, closeNotifierDelegator{w}}
+	}
+	pickDelegator[flusher] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.Flusher
+		}{w, flusherDelegator{w}}
+	}
+	pickDelegator[closeNotifier|flusher] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.CloseNotifier
+			http.Flusher
+		}{w, closeNotifierDelegator{w}, flusherDelegator{w}}
+	}
+	pickDelegator[hijacker] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.Hijacker
+		}{w, hijackerDelegator{w}}
+	}
+	pickDelegator[closeNotifier|hijacker] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.CloseNotifier
+			http.Hijacker
+		}{w, closeNotifierDelegator{w}, hijackerDelegator{w}}
+	}
+	pickDelegator[flusher|hijacker] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.Flusher
+			http.Hijacker
+		}{w, flusherDelegator{w}, hijackerDelegator{w}}
+	}
+	pickDelegator[closeNotifier|flusher|hijacker] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.CloseNotifier
+			http.Flusher
+			http.Hijacker
+		}{w, closeNotifierDelegator{w}, flusherDelegator{w}, hijackerDelegator{w}}
+	}
+	pickDelegator[readerFrom] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			io.ReaderFrom
+		}{w, readerFromDelegator{w}}
+	}
+	pickDelegator[closeNotifier|readerFrom] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.CloseNotifier
+			io.ReaderFrom
+		}{w, closeNotifierDelegator{w}, readerFromDelegator{w}}
+	}
+	pickDelegator[flusher|readerFrom] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.Flusher
+			io.ReaderFrom
+		}{w, flusherDelegator{w}, readerFromDelegator{w}}
+	}
+	pickDelegator[closeNotifier|flusher|readerFrom] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.CloseNotifier
+			http.Flusher
+			io.ReaderFrom
+		}{w, closeNotifierDelegator{w}, flusherDelegator{w}, readerFromDelegator{w}}
+	}
+	pickDelegator[hijacker|readerFrom] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.Hijacker
+			io.ReaderFrom
+		}{w, hijackerDelegator{w}, readerFromDelegator{w}}
+	}
+	pickDelegator[closeNotifier|hijacker|readerFrom] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.CloseNotifier
+			http.Hijacker
+			io.ReaderFrom
+		}{w, closeNotifierDelegator{w}, hijackerDelegator{w}, readerFromDelegator{w}}
+	}
+	pickDelegator[flusher|hijacker|readerFrom] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{w, flusherDelegator{w}, hijackerDelegator{w}, readerFromDelegator{w}}
+	}
+	pickDelegator[closeNotifier|flusher|hijacker|readerFrom] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.CloseNotifier
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{w, closeNotifierDelegator{w}, flusherDelegator{w}, hijackerDelegator{w}, readerFromDelegator{w}}
+	}
+	pickDelegator[pusher] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.Pusher
+		}{w, pusherDelegator{w}}
+	}
+	pickDelegator[closeNotifier|pusher] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.CloseNotifier
+			http.Pusher
+		}{w, closeNotifierDelegator{w}, pusherDelegator{w}}
+	}
+	pickDelegator[flusher|pusher] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.Flusher
+			http.Pusher
+		}{w, flusherDelegator{w}, pusherDelegator{w}}
+	}
+	pickDelegator[closeNotifier|flusher|pusher] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.CloseNotifier
+			http.Flusher
+			http.Pusher
+		}{w, closeNotifierDelegator{w}, flusherDelegator{w}, pusherDelegator{w}}
+	}
+	pickDelegator[hijacker|pusher] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.Hijacker
+			http.Pusher
+		}{w, hijackerDelegator{w}, pusherDelegator{w}}
+	}
+	pickDelegator[closeNotifier|hijacker|pusher] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.CloseNotifier
+			http.Hijacker
+			http.Pusher
+		}{w, closeNotifierDelegator{w}, hijackerDelegator{w}, pusherDelegator{w}}
+	}
+	pickDelegator[flusher|hijacker|pusher] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{w, flusherDelegator{w}, hijackerDelegator{w}, pusherDelegator{w}}
+	}
+	pickDelegator[closeNotifier|flusher|hijacker|pusher] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.CloseNotifier
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{w, closeNotifierDelegator{w}, flusherDelegator{w}, hijackerDelegator{w}, pusherDelegator{w}}
+	}
+	pickDelegator[readerFrom|pusher] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			io.ReaderFrom
+			http.Pusher
+		}{w, readerFromDelegator{w}, pusherDelegator{w}}
+	}
+	pickDelegator[closeNotifier|readerFrom|pusher] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.CloseNotifier
+			io.ReaderFrom
+			http.Pusher
+		}{w, closeNotifierDelegator{w}, readerFromDelegator{w}, pusherDelegator{w}}
+	}
+	pickDelegator[flusher|readerFrom|pusher] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.Flusher
+			io.ReaderFrom
+			http.Pusher
+		}{w, flusherDelegator{w}, readerFromDelegator{w}, pusherDelegator{w}}
+	}
+	pickDelegator[closeNotifier|flusher|readerFrom|pusher] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.CloseNotifier
+			http.Flusher
+			io.ReaderFrom
+			http.Pusher
+		}{w, closeNotifierDelegator{w}, flusherDelegator{w}, readerFromDelegator{w}, pusherDelegator{w}}
+	}
+	pickDelegator[hijacker|readerFrom|pusher] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{w, hijackerDelegator{w}, readerFromDelegator{w}, pusherDelegator{w}}
+	}
+	pickDelegator[closeNotifier|hijacker|readerFrom|pusher] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.CloseNotifier
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{w, closeNotifierDelegator{w}, hijackerDelegator{w}, readerFromDelegator{w}, pusherDelegator{w}}
+	}
+	pickDelegator[flusher|hijacker|readerFrom|pusher] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{w, flusherDelegator{w}, hijackerDelegator{w}, readerFromDelegator{w}, pusherDelegator{w}}
+	}
+	pickDelegator[closeNotifier|flusher|hijacker|readerFrom|pusher] = func(w *responseWriterInterceptor) http.ResponseWriter {
+		return struct {
+			*responseWriterInterceptor
+			http.CloseNotifier
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{w, closeNotifierDelegator{w}, flusherDelegator{w}, hijackerDelegator{w}, readerFromDelegator{w}, pusherDelegator{w}}
+	}
+}
+
+// newResponseWriter returns a http.ResponseWriter that intercepts the writes on
+// the interceptor and implements the same optional interfaces (http.Flusher,
+// http.Hijacker...) as the writer wrapped by the interceptor.
+func newResponseWriter(wi *responseWriterInterceptor) http.ResponseWriter {
+	id := 0
+	if _, ok := wi.ResponseWriter.(http.CloseNotifier); ok {
+		id |= closeNotifier
+	}
+	if _, ok := wi.ResponseWriter.(http.Flusher); ok {
+		id |= flusher
+	}
+	if _, ok := wi.ResponseWriter.(http.Hijacker); ok {
+		id |= hijacker
+	}
+	if _, ok := wi.ResponseWriter.(io.ReaderFrom); ok {
+		id |= readerFrom
+	}
+	if _, ok := wi.ResponseWriter.(http.Pusher); ok {
+		id |= pusher
+	}
+
+	return pickDelegator[id](wi)
+}
+
+// bodyInterceptor is a simple wrapper to intercept the data read from a
+// request body.
+type bodyInterceptor struct {
+	io.ReadCloser
+	bytesRead int64
+}
+
+func (b *bodyInterceptor) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytesRead += int64(n)
+	return n, err
+}
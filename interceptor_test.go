@@ -0,0 +1,715 @@
+package middleware_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	prommiddleware "github.com/slok/go-prometheus-middleware"
+)
+
+// fakeResponseWriter implements all the optional interfaces of a http.ResponseWriter
+// and registers the calls made to them.
+type fakeResponseWriter struct {
+	*httptest.ResponseRecorder
+	calls []string
+}
+
+func (f *fakeResponseWriter) CloseNotify() <-chan bool {
+	f.calls = append(f.calls, "CloseNotify")
+	return make(chan bool)
+}
+
+func (f *fakeResponseWriter) Flush() {
+	f.calls = append(f.calls, "Flush")
+}
+
+func (f *fakeResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	f.calls = append(f.calls, "Hijack")
+	return nil, nil, nil
+}
+
+func (f *fakeResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	f.calls = append(f.calls, "ReadFrom")
+	return io.Copy(f.ResponseRecorder, r)
+}
+
+func (f *fakeResponseWriter) Push(target string, opts *http.PushOptions) error {
+	f.calls = append(f.calls, "Push")
+	return nil
+}
+
+func TestMiddlewareHandlerOptionalInterfaces(t *testing.T) {
+	tests := []struct {
+		name             string
+		writer           func(f *fakeResponseWriter) http.ResponseWriter
+		expCloseNotifier bool
+		expFlusher       bool
+		expHijacker      bool
+		expReaderFrom    bool
+		expPusher        bool
+	}{
+		{
+			name: "writer with no optional interfaces should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct{ http.ResponseWriter }{f}
+			},
+		},
+		{
+			name: "writer with CloseNotifier should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.CloseNotifier
+				}{f, f}
+			},
+			expCloseNotifier: true,
+		},
+		{
+			name: "writer with Flusher should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.Flusher
+				}{f, f}
+			},
+			expFlusher: true,
+		},
+		{
+			name: "writer with CloseNotifier, Flusher should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.CloseNotifier
+					http.Flusher
+				}{f, f, f}
+			},
+			expCloseNotifier: true,
+			expFlusher:       true,
+		},
+		{
+			name: "writer with Hijacker should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.Hijacker
+				}{f, f}
+			},
+			expHijacker: true,
+		},
+		{
+			name: "writer with CloseNotifier, Hijacker should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.CloseNotifier
+					http.Hijacker
+				}{f, f, f}
+			},
+			expCloseNotifier: true,
+			expHijacker:      true,
+		},
+		{
+			name: "writer with Flusher, Hijacker should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.Flusher
+					http.Hijacker
+				}{f, f, f}
+			},
+			expFlusher:  true,
+			expHijacker: true,
+		},
+		{
+			name: "writer with CloseNotifier, Flusher, Hijacker should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.CloseNotifier
+					http.Flusher
+					http.Hijacker
+				}{f, f, f, f}
+			},
+			expCloseNotifier: true,
+			expFlusher:       true,
+			expHijacker:      true,
+		},
+		{
+			name: "writer with ReaderFrom should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					io.ReaderFrom
+				}{f, f}
+			},
+			expReaderFrom: true,
+		},
+		{
+			name: "writer with CloseNotifier, ReaderFrom should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.CloseNotifier
+					io.ReaderFrom
+				}{f, f, f}
+			},
+			expCloseNotifier: true,
+			expReaderFrom:    true,
+		},
+		{
+			name: "writer with Flusher, ReaderFrom should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.Flusher
+					io.ReaderFrom
+				}{f, f, f}
+			},
+			expFlusher:    true,
+			expReaderFrom: true,
+		},
+		{
+			name: "writer with CloseNotifier, Flusher, ReaderFrom should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.CloseNotifier
+					http.Flusher
+					io.ReaderFrom
+				}{f, f, f, f}
+			},
+			expCloseNotifier: true,
+			expFlusher:       true,
+			expReaderFrom:    true,
+		},
+		{
+			name: "writer with Hijacker, ReaderFrom should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.Hijacker
+					io.ReaderFrom
+				}{f, f, f}
+			},
+			expHijacker:   true,
+			expReaderFrom: true,
+		},
+		{
+			name: "writer with CloseNotifier, Hijacker, ReaderFrom should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.CloseNotifier
+					http.Hijacker
+					io.ReaderFrom
+				}{f, f, f, f}
+			},
+			expCloseNotifier: true,
+			expHijacker:      true,
+			expReaderFrom:    true,
+		},
+		{
+			name: "writer with Flusher, Hijacker, ReaderFrom should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.Flusher
+					http.Hijacker
+					io.ReaderFrom
+				}{f, f, f, f}
+			},
+			expFlusher:    true,
+			expHijacker:   true,
+			expReaderFrom: true,
+		},
+		{
+			name: "writer with CloseNotifier, Flusher, Hijacker, ReaderFrom should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.CloseNotifier
+					http.Flusher
+					http.Hijacker
+					io.ReaderFrom
+				}{f, f, f, f, f}
+			},
+			expCloseNotifier: true,
+			expFlusher:       true,
+			expHijacker:      true,
+			expReaderFrom:    true,
+		},
+		{
+			name: "writer with Pusher should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.Pusher
+				}{f, f}
+			},
+			expPusher: true,
+		},
+		{
+			name: "writer with CloseNotifier, Pusher should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.CloseNotifier
+					http.Pusher
+				}{f, f, f}
+			},
+			expCloseNotifier: true,
+			expPusher:        true,
+		},
+		{
+			name: "writer with Flusher, Pusher should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.Flusher
+					http.Pusher
+				}{f, f, f}
+			},
+			expFlusher: true,
+			expPusher:  true,
+		},
+		{
+			name: "writer with CloseNotifier, Flusher, Pusher should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.CloseNotifier
+					http.Flusher
+					http.Pusher
+				}{f, f, f, f}
+			},
+			expCloseNotifier: true,
+			expFlusher:       true,
+			expPusher:        true,
+		},
+		{
+			name: "writer with Hijacker, Pusher should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.Hijacker
+					http.Pusher
+				}{f, f, f}
+			},
+			expHijacker: true,
+			expPusher:   true,
+		},
+		{
+			name: "writer with CloseNotifier, Hijacker, Pusher should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.CloseNotifier
+					http.Hijacker
+					http.Pusher
+				}{f, f, f, f}
+			},
+			expCloseNotifier: true,
+			expHijacker:      true,
+			expPusher:        true,
+		},
+		{
+			name: "writer with Flusher, Hijacker, Pusher should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.Flusher
+					http.Hijacker
+					http.Pusher
+				}{f, f, f, f}
+			},
+			expFlusher:  true,
+			expHijacker: true,
+			expPusher:   true,
+		},
+		{
+			name: "writer with CloseNotifier, Flusher, Hijacker, Pusher should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.CloseNotifier
+					http.Flusher
+					http.Hijacker
+					http.Pusher
+				}{f, f, f, f, f}
+			},
+			expCloseNotifier: true,
+			expFlusher:       true,
+			expHijacker:      true,
+			expPusher:        true,
+		},
+		{
+			name: "writer with ReaderFrom, Pusher should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					io.ReaderFrom
+					http.Pusher
+				}{f, f, f}
+			},
+			expReaderFrom: true,
+			expPusher:     true,
+		},
+		{
+			name: "writer with CloseNotifier, ReaderFrom, Pusher should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.CloseNotifier
+					io.ReaderFrom
+					http.Pusher
+				}{f, f, f, f}
+			},
+			expCloseNotifier: true,
+			expReaderFrom:    true,
+			expPusher:        true,
+		},
+		{
+			name: "writer with Flusher, ReaderFrom, Pusher should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.Flusher
+					io.ReaderFrom
+					http.Pusher
+				}{f, f, f, f}
+			},
+			expFlusher:    true,
+			expReaderFrom: true,
+			expPusher:     true,
+		},
+		{
+			name: "writer with CloseNotifier, Flusher, ReaderFrom, Pusher should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.CloseNotifier
+					http.Flusher
+					io.ReaderFrom
+					http.Pusher
+				}{f, f, f, f, f}
+			},
+			expCloseNotifier: true,
+			expFlusher:       true,
+			expReaderFrom:    true,
+			expPusher:        true,
+		},
+		{
+			name: "writer with Hijacker, ReaderFrom, Pusher should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.Hijacker
+					io.ReaderFrom
+					http.Pusher
+				}{f, f, f, f}
+			},
+			expHijacker:   true,
+			expReaderFrom: true,
+			expPusher:     true,
+		},
+		{
+			name: "writer with CloseNotifier, Hijacker, ReaderFrom, Pusher should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.CloseNotifier
+					http.Hijacker
+					io.ReaderFrom
+					http.Pusher
+				}{f, f, f, f, f}
+			},
+			expCloseNotifier: true,
+			expHijacker:      true,
+			expReaderFrom:    true,
+			expPusher:        true,
+		},
+		{
+			name: "writer with Flusher, Hijacker, ReaderFrom, Pusher should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.Flusher
+					http.Hijacker
+					io.ReaderFrom
+					http.Pusher
+				}{f, f, f, f, f}
+			},
+			expFlusher:    true,
+			expHijacker:   true,
+			expReaderFrom: true,
+			expPusher:     true,
+		},
+		{
+			name: "writer with CloseNotifier, Flusher, Hijacker, ReaderFrom, Pusher should maintain the same interfaces.",
+			writer: func(f *fakeResponseWriter) http.ResponseWriter {
+				return struct {
+					http.ResponseWriter
+					http.CloseNotifier
+					http.Flusher
+					http.Hijacker
+					io.ReaderFrom
+					http.Pusher
+				}{f, f, f, f, f, f}
+			},
+			expCloseNotifier: true,
+			expFlusher:       true,
+			expHijacker:      true,
+			expReaderFrom:    true,
+			expPusher:        true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			reg := prometheus.NewRegistry()
+			m := prommiddleware.New(prommiddleware.Config{}, reg)
+
+			var expCalls []string
+			h := m.Handler("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				cn, ok := w.(http.CloseNotifier)
+				if assert.Equal(test.expCloseNotifier, ok) && ok {
+					cn.CloseNotify()
+					expCalls = append(expCalls, "CloseNotify")
+				}
+
+				f, ok := w.(http.Flusher)
+				if assert.Equal(test.expFlusher, ok) && ok {
+					f.Flush()
+					expCalls = append(expCalls, "Flush")
+				}
+
+				hj, ok := w.(http.Hijacker)
+				if assert.Equal(test.expHijacker, ok) && ok {
+					hj.Hijack()
+					expCalls = append(expCalls, "Hijack")
+				}
+
+				rf, ok := w.(io.ReaderFrom)
+				if assert.Equal(test.expReaderFrom, ok) && ok {
+					rf.ReadFrom(strings.NewReader("test"))
+					expCalls = append(expCalls, "ReadFrom")
+				}
+
+				p, ok := w.(http.Pusher)
+				if assert.Equal(test.expPusher, ok) && ok {
+					p.Push("/test", nil)
+					expCalls = append(expCalls, "Push")
+				}
+			}))
+
+			f := &fakeResponseWriter{ResponseRecorder: httptest.NewRecorder()}
+			h.ServeHTTP(test.writer(f), httptest.NewRequest("GET", "/test", nil))
+
+			assert.Equal(expCalls, f.calls)
+
+			// Data written with ReadFrom should be measured.
+			if test.expReaderFrom {
+				assert.Contains(getMetrics(reg), `http_response_size_bytes_sum{code="200",handler="test",method="GET"} 4`)
+			}
+		})
+	}
+}
+
+func TestMiddlewareHandlerResponseController(t *testing.T) {
+	assert := assert.New(t)
+
+	reg := prometheus.NewRegistry()
+	m := prommiddleware.New(prommiddleware.Config{}, reg)
+
+	var deadlineErr, duplexErr error
+	h := m.Handler("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		deadlineErr = rc.SetWriteDeadline(time.Now().Add(time.Minute))
+		duplexErr = rc.EnableFullDuplex()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	// Use a real server so the original writer supports the response controller features.
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if assert.NoError(err) {
+		resp.Body.Close()
+	}
+
+	assert.NoError(deadlineErr)
+	assert.NoError(duplexErr)
+	assert.Contains(getMetrics(reg), `http_request_duration_seconds_count{code="202",handler="test",method="GET"} 1`)
+}
+
+func TestMiddlewareHandlerStatusCode(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		expCode string
+	}{
+		{
+			name:    "A handler that doesn't write should be measured with the implicit status code.",
+			handler: func(w http.ResponseWriter, r *http.Request) {},
+			expCode: "200",
+		},
+		{
+			name: "A handler that writes without status code should be measured with the implicit status code.",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("test"))
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			expCode: "200",
+		},
+		{
+			name: "A handler that flushes without status code should be measured with the implicit status code.",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.(http.Flusher).Flush()
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			expCode: "200",
+		},
+		{
+			name: "A handler that writes the status code multiple times should be measured with the first one.",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusCreated)
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			expCode: "201",
+		},
+		{
+			name: "A handler that writes informational status codes should be measured with the final status code.",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusEarlyHints)
+				w.WriteHeader(http.StatusContinue)
+				w.WriteHeader(http.StatusAccepted)
+			},
+			expCode: "202",
+		},
+		{
+			name: "A handler that switches protocols should be measured with the switching protocols status code.",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusSwitchingProtocols)
+			},
+			expCode: "101",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			m := prommiddleware.New(prommiddleware.Config{}, reg)
+			h := m.Handler("test", test.handler)
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+
+			expMetric := fmt.Sprintf(`http_request_duration_seconds_count{code=%q,handler="test",method="GET"} 1`, test.expCode)
+			assert.Contains(t, getMetrics(reg), expMetric)
+		})
+	}
+}
+
+// reporterResponseWriter is a writer that reports a response written by other writer.
+type reporterResponseWriter struct {
+	http.ResponseWriter
+	statusCode   int
+	bytesWritten int64
+	wroteHeader  bool
+}
+
+func (r *reporterResponseWriter) StatusCode() int     { return r.statusCode }
+func (r *reporterResponseWriter) BytesWritten() int64 { return r.bytesWritten }
+func (r *reporterResponseWriter) WroteHeader() bool   { return r.wroteHeader }
+
+func TestMiddlewareHandlerResponseReporter(t *testing.T) {
+	assert := assert.New(t)
+
+	reg := prometheus.NewRegistry()
+	m := prommiddleware.New(prommiddleware.Config{}, reg)
+
+	// The handler doesn't write on the received writer, it writes on the reporter
+	// writer like the frameworks that have their own writer.
+	rw := &reporterResponseWriter{ResponseWriter: httptest.NewRecorder()}
+	h := m.Handler("test", http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		rw.statusCode = http.StatusTeapot
+		rw.bytesWritten = 42
+		rw.wroteHeader = true
+	}))
+	h.ServeHTTP(rw, httptest.NewRequest("GET", "/test", nil))
+
+	metrics := getMetrics(reg)
+	assert.Contains(metrics, `http_request_duration_seconds_count{code="418",handler="test",method="GET"} 1`)
+	assert.Contains(metrics, `http_response_size_bytes_sum{code="418",handler="test",method="GET"} 42`)
+}
+
+// firstByteReporterResponseWriter is a reporter writer that also reports when the
+// first byte of the response was written.
+type firstByteReporterResponseWriter struct {
+	reporterResponseWriter
+	firstByteAt time.Time
+}
+
+func (r *firstByteReporterResponseWriter) FirstByteAt() time.Time { return r.firstByteAt }
+
+func TestMiddlewareHandlerFirstByteReporter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writer func() (http.ResponseWriter, func(time.Time))
+		expMin time.Duration
+		expMax time.Duration
+	}{
+		{
+			name: "A reporter without first byte should measure the time to first byte until the handler returns.",
+			writer: func() (http.ResponseWriter, func(time.Time)) {
+				rw := &reporterResponseWriter{ResponseWriter: httptest.NewRecorder()}
+				return rw, func(time.Time) { rw.wroteHeader = true }
+			},
+			expMin: 100 * time.Millisecond,
+			expMax: time.Minute,
+		},
+		{
+			name: "A reporter with first byte should measure the time to first byte until the reported first byte.",
+			writer: func() (http.ResponseWriter, func(time.Time)) {
+				rw := &firstByteReporterResponseWriter{reporterResponseWriter: reporterResponseWriter{ResponseWriter: httptest.NewRecorder()}}
+				return rw, func(at time.Time) {
+					rw.wroteHeader = true
+					rw.firstByteAt = at
+				}
+			},
+			expMin: 0,
+			expMax: 100 * time.Millisecond,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			rec := newFakeRecorder()
+			m := prommiddleware.NewWithRecorder(prommiddleware.Config{}, rec)
+
+			// The handler writes on the reporter writer and takes time to finish.
+			rw, write := test.writer()
+			h := m.Handler("test", http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+				write(time.Now())
+				time.Sleep(100 * time.Millisecond)
+			}))
+			h.ServeHTTP(rw, httptest.NewRequest("GET", "/test", nil))
+
+			ttfb := rec.ttfbs["test"]
+			assert.GreaterOrEqual(ttfb, test.expMin)
+			assert.Less(ttfb, test.expMax)
+		})
+	}
+}
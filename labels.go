@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"unicode/utf8"
+)
+
+// ExtraLabel is an extra label set on the HTTP request metrics with a value obtained
+// from the request.
+type ExtraLabel struct {
+	// Name is the name of the label.
+	Name string
+	// AllowedValues are the values allowed for the label, any other value will be replaced
+	// by the Fallback value, this way a malicious request can't create unbounded series. If
+	// empty all the values are allowed, use it only when the values are already bounded.
+	AllowedValues []string
+	// Fallback is the value used when the value of the request is not allowed or is not
+	// valid UTF-8, by default `other`.
+	Fallback string
+}
+
+// labelNameRegexp is the regexp that the label names need to match.
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedLabels are the labels already used by the middleware metrics.
+var reservedLabels = map[string]bool{
+	"handler": true,
+	"method":  true,
+	"code":    true,
+	"le":      true,
+}
+
+// validateExtraLabels validates the extra labels and returns them with the defaults set.
+func validateExtraLabels(labels []ExtraLabel) ([]ExtraLabel, error) {
+	// Don't modify the original slice.
+	res := make([]ExtraLabel, 0, len(labels))
+	names := map[string]bool{}
+	for _, l := range labels {
+		if !labelNameRegexp.MatchString(l.Name) {
+			return nil, fmt.Errorf("invalid extra label name %q", l.Name)
+		}
+		if reservedLabels[l.Name] {
+			return nil, fmt.Errorf("extra label name %q is reserved", l.Name)
+		}
+		if names[l.Name] {
+			return nil, fmt.Errorf("extra label name %q is duplicated", l.Name)
+		}
+		names[l.Name] = true
+
+		if l.Fallback == "" {
+			l.Fallback = "other"
+		}
+		if !utf8.ValidString(l.Fallback) {
+			return nil, fmt.Errorf("extra label %q fallback is not valid UTF-8", l.Name)
+		}
+		for _, v := range l.AllowedValues {
+			if !utf8.ValidString(v) {
+				return nil, fmt.Errorf("extra label %q allowed value %q is not valid UTF-8", l.Name, v)
+			}
+		}
+		res = append(res, l)
+	}
+
+	return res, nil
+}
+
+// extraLabeler gets the allowed extra label values from the requests.
+type extraLabeler struct {
+	labels    []ExtraLabel
+	allowed   []map[string]bool
+	extractor func(r *http.Request) []string
+}
+
+func newExtraLabeler(labels []ExtraLabel, extractor func(r *http.Request) []string) *extraLabeler {
+	allowed := make([]map[string]bool, len(labels))
+	for i, l := range labels {
+		if len(l.AllowedValues) == 0 {
+			continue
+		}
+
+		allowed[i] = map[string]bool{}
+		for _, v := range l.AllowedValues {
+			allowed[i][v] = true
+		}
+	}
+
+	return &extraLabeler{
+		labels:    labels,
+		allowed:   allowed,
+		extractor: extractor,
+	}
+}
+
+// labelsFor returns the extra labels of the request, the missing, not allowed or
+// not valid UTF-8 values are replaced with the fallback value of the label.
+func (e *extraLabeler) labelsFor(r *http.Request) []Label {
+	values := e.extractor(r)
+
+	res := make([]Label, len(e.labels))
+	for i, l := range e.labels {
+		v := l.Fallback
+		if i < len(values) && e.valid(i, values[i]) {
+			v = values[i]
+		}
+		res[i] = Label{Name: l.Name, Value: v}
+	}
+
+	return res
+}
+
+// valid returns true if the value can be used as the value of the extra label.
+func (e *extraLabeler) valid(i int, v string) bool {
+	if e.allowed[i] != nil {
+		return e.allowed[i][v]
+	}
+
+	// Prometheus panics with the label values that are not valid UTF-8.
+	return utf8.ValidString(v)
+}
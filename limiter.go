@@ -0,0 +1,48 @@
+package middleware
+
+import "sync"
+
+// handlerLimiter limits the number of different handler IDs, once the limit is
+// reached the new handler IDs are replaced by the overflow handler ID.
+type handlerLimiter struct {
+	max      int
+	overflow string
+
+	mu  sync.RWMutex
+	ids map[string]struct{}
+}
+
+func newHandlerLimiter(max int, overflow string) *handlerLimiter {
+	return &handlerLimiter{
+		max:      max,
+		overflow: overflow,
+		ids:      map[string]struct{}{},
+	}
+}
+
+// limit returns the handler ID that should be used and true if the
+// received handler ID has been replaced by the overflow one.
+func (h *handlerLimiter) limit(id string) (string, bool) {
+	// Fast path, most of the times the handler ID is already known.
+	h.mu.RLock()
+	_, ok := h.ids[id]
+	h.mu.RUnlock()
+	if ok {
+		return id, false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Check again, could have been added while we were acquiring the lock.
+	if _, ok := h.ids[id]; ok {
+		return id, false
+	}
+
+	if len(h.ids) >= h.max {
+		return h.overflow, true
+	}
+
+	h.ids[id] = struct{}{}
+	return id, false
+}
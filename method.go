@@ -0,0 +1,62 @@
+package middleware
+
+import "net/http"
+
+// otherMethod is the method label used for the methods that are not accepted.
+const otherMethod = "other"
+
+// methodOverrideHeader is the header used by the clients to override the request method.
+const methodOverrideHeader = "X-HTTP-Method-Override"
+
+// standardMethods are the HTTP methods defined by RFC 7231 and RFC 5789.
+var standardMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodDelete,
+	http.MethodConnect,
+	http.MethodOptions,
+	http.MethodTrace,
+	http.MethodPatch,
+}
+
+// methodLabeler gets the method label of the requests.
+type methodLabeler struct {
+	methods  map[string]bool
+	override bool
+}
+
+func newMethodLabeler(extraMethods []string, override bool) *methodLabeler {
+	methods := map[string]bool{}
+	for _, m := range standardMethods {
+		methods[m] = true
+	}
+	for _, m := range extraMethods {
+		methods[m] = true
+	}
+
+	return &methodLabeler{
+		methods:  methods,
+		override: override,
+	}
+}
+
+// methodFor returns the method label of the request, if the method is not
+// accepted it will return `other`.
+func (m *methodLabeler) methodFor(r *http.Request) string {
+	method := r.Method
+
+	// Method override is only used with POST requests, like the frameworks that support it.
+	if m.override && method == http.MethodPost {
+		if om := r.Header.Get(methodOverrideHeader); om != "" {
+			method = om
+		}
+	}
+
+	if !m.methods[method] {
+		return otherMethod
+	}
+
+	return method
+}
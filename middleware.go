@@ -5,9 +5,13 @@
 package middleware
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -20,22 +24,236 @@ type Config struct {
 	// Buckets are the buckets used by Prometheus for the HTTP request metrics, by default
 	// Uses Prometheus default buckets (from 5ms to 10s).
 	Buckets []float64
+	// NativeHistogramBucketFactor enables the Prometheus native histograms for the HTTP request
+	// latency metrics when it's greater than 1, the native histograms have exponential buckets
+	// where each bucket is at most this factor wider than the previous one (e.g 1.1 for a 10%
+	// maximum error on the quantiles). The native histograms are only exposed with the protobuf
+	// format, so Prometheus needs the native histograms feature enabled.
+	// By default is disabled.
+	NativeHistogramBucketFactor float64
+	// NativeHistogramMaxBucketNumber is the maximum number of buckets of the native histograms,
+	// once reached the resolution of the histogram is reduced. By default 160.
+	NativeHistogramMaxBucketNumber uint32
+	// NativeHistogramZeroThreshold is the width of the native histograms zero bucket, the
+	// observations closer to zero than this are counted on the zero bucket. By default uses the
+	// Prometheus default zero threshold.
+	NativeHistogramZeroThreshold float64
+	// NativeHistogramWithClassicBuckets will measure the latency native histograms also with the
+	// classic Buckets, this is useful while migrating the dashboards and alerts to the native
+	// histograms. By default the native histograms don't have classic buckets.
+	NativeHistogramWithClassicBuckets bool
+	// SummaryObjectives are the quantile objectives (quantile to absolute error) of the HTTP request
+	// latency summary, when set the latency is also measured with a Prometheus summary named
+	// `http_request_summary_duration_seconds` that has the same labels as the latency histogram,
+	// e.g `{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}`.
+	// By default is disabled.
+	SummaryObjectives map[float64]float64
+	// SummaryOnly will measure the HTTP request latency only with the summary (instead of the
+	// histogram), in this case the summary is named `http_request_duration_seconds`. Requires
+	// SummaryObjectives. By default is disabled.
+	SummaryOnly bool
+	// SummaryMaxAge is the duration for which the observations are kept to compute the
+	// summary quantiles, by default 10m.
+	SummaryMaxAge time.Duration
+	// SummaryAgeBuckets is the number of buckets used to exclude the observations older
+	// than SummaryMaxAge from the summary quantiles, by default 5.
+	SummaryAgeBuckets uint32
+	// SizeBuckets are the buckets used by Prometheus for the HTTP request and response size metrics,
+	// by default uses exponential buckets from 100B to 1GB.
+	SizeBuckets []float64
 	// GroupedStatus will group the status label in the form of `\dxx`, for example,
 	// 200, 201, and 203 will have the label `code="2xx"`. This impacts on the cardinality
 	// of the metrics and also improves the performance of queries that are grouped by
 	// status code because there are already aggregated in the metric.
+	// It applies to the latency and size metrics, the requests counter status label is
+	// set with CounterGroupedStatus.
 	// By default will be false.
 	GroupedStatus bool
+	// CounterGroupedStatus will group the status label of the requests counter in the same
+	// way as GroupedStatus. This way the histograms can use grouped status codes to keep the
+	// buckets cheap while the counter has the exact status codes (e.g for error budgets).
+	// By default will be false.
+	CounterGroupedStatus bool
+	// ExtraMethods are the HTTP methods accepted as method label besides the standard ones
+	// (RFC 7231 and RFC 5789), e.g WebDAV `PROPFIND`. The requests with methods that are not
+	// accepted will be measured with the `other` method label.
+	// By default only the standard methods are accepted.
+	ExtraMethods []string
+	// MethodOverride will use the method of the `X-HTTP-Method-Override` header as the method
+	// label on POST requests, the same way the frameworks that support method override do.
+	// By default is disabled.
+	MethodOverride bool
+	// PathNormalizer is used to normalize the request URL path when the handler ID is inferred
+	// from the request (empty handler ID), e.g `/users/123` to `/users/:id`. This is required to
+	// keep the cardinality of the handler label under control. DefaultPathNormalizer can be used
+	// to normalize the paths with the built-in rules.
+	// By default is disabled, so the raw path is used.
+	PathNormalizer PathNormalizer
+	// MaxHandlerLabels is the maximum number of different handler label values that the middleware
+	// will measure, once reached the requests of new handler IDs will be measured using the
+	// HandlerLabelOverflow handler ID. This protects the metrics backend from a cardinality explosion
+	// (e.g a scanner requesting random URLs when the handler ID is inferred from the request).
+	// By default is disabled.
+	MaxHandlerLabels int
+	// HandlerLabelOverflow is the handler label value used for the requests measured once
+	// MaxHandlerLabels is reached, by default `other`.
+	HandlerLabelOverflow string
+	// ExtraLabels are extra labels set on the HTTP request metrics (counter, latency and sizes) with
+	// the values obtained from the request using ExtraLabelsExtractor, e.g `tenant` or `api_version`.
+	// Use the allowed values of the labels to keep the cardinality under control.
+	// By default there are no extra labels.
+	ExtraLabels []ExtraLabel
+	// ExtraLabelsExtractor is the function that returns the values of the ExtraLabels for a request,
+	// in the same order as the ExtraLabels. Required when there are ExtraLabels.
+	ExtraLabelsExtractor func(r *http.Request) []string
+	// RecoverPanics will recover the panics of the wrapped handlers writing an internal error
+	// response (if the headers have not been already written) instead of panicking again. The
+	// panics are always measured as internal errors (500) and counted, no matter this option.
+	// The handler aborts (http.ErrAbortHandler) are never recovered and are measured as
+	// aborted by the client. By default is disabled.
+	RecoverPanics bool
+	// ClientAbortedCode is the status code used to measure the requests where the client
+	// disconnected (the request context has been canceled) before the handler finished,
+	// by default 499 (like Nginx).
+	ClientAbortedCode int
+	// TraceIDExtractor is the function used to get the trace ID of a request, when it returns
+	// a trace ID the request latency will be measured with an exemplar that has the trace ID
+	// (`trace_id` label), this way the metrics can be correlated with the traces. OTelTraceID
+	// can be used to get the trace ID from the OpenTelemetry span context.
+	// By default is disabled.
+	TraceIDExtractor func(r *http.Request) string
 }
 
-func (c *Config) validate() {
+// invalidUTF8Replacement replaces the invalid UTF-8 bytes of the handler IDs inferred from
+// the URL path.
+const invalidUTF8Replacement = "\uFFFD"
+
+// prefixRegexp is the regexp that the prefix needs to match so the metric names are valid.
+var prefixRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+func (c *Config) validate() error {
+	if c.Prefix != "" && !prefixRegexp.MatchString(c.Prefix) {
+		return fmt.Errorf("invalid prefix %q, it should match %s", c.Prefix, prefixRegexp)
+	}
+
+	if err := validateBuckets(c.Buckets); err != nil {
+		return fmt.Errorf("invalid buckets: %w", err)
+	}
+
+	if c.NativeHistogramBucketFactor != 0 && c.NativeHistogramBucketFactor <= 1 {
+		return fmt.Errorf("invalid native histogram bucket factor %v, it should be greater than 1", c.NativeHistogramBucketFactor)
+	}
+
+	if c.NativeHistogramZeroThreshold < 0 {
+		return fmt.Errorf("invalid native histogram zero threshold, it can't be negative")
+	}
+
+	if err := validateObjectives(c.SummaryObjectives); err != nil {
+		return fmt.Errorf("invalid summary objectives: %w", err)
+	}
+
+	if c.SummaryOnly && len(c.SummaryObjectives) == 0 {
+		return fmt.Errorf("summary only requires summary objectives")
+	}
+
+	if c.SummaryMaxAge < 0 {
+		return fmt.Errorf("invalid summary max age, it can't be negative")
+	}
+
+	if err := validateBuckets(c.SizeBuckets); err != nil {
+		return fmt.Errorf("invalid size buckets: %w", err)
+	}
+
+	if c.MaxHandlerLabels < 0 {
+		return fmt.Errorf("invalid max handler labels, it can't be negative")
+	}
+
+	if c.ClientAbortedCode != 0 && (c.ClientAbortedCode < 100 || c.ClientAbortedCode > 999) {
+		return fmt.Errorf("invalid client aborted code %d", c.ClientAbortedCode)
+	}
+
+	if len(c.ExtraLabels) > 0 && c.ExtraLabelsExtractor == nil {
+		return fmt.Errorf("extra labels require an extra labels extractor")
+	}
+
+	extraLabels, err := validateExtraLabels(c.ExtraLabels)
+	if err != nil {
+		return err
+	}
+	c.ExtraLabels = extraLabels
+
+	// The summaries use the quantile label for the objectives.
+	if len(c.SummaryObjectives) > 0 {
+		for _, l := range c.ExtraLabels {
+			if l.Name == "quantile" {
+				return fmt.Errorf("extra label name %q is reserved when using summary objectives", l.Name)
+			}
+		}
+	}
+
 	if len(c.Buckets) == 0 {
 		c.Buckets = prometheus.DefBuckets
 	}
+
+	if c.NativeHistogramBucketFactor > 1 && c.NativeHistogramMaxBucketNumber == 0 {
+		c.NativeHistogramMaxBucketNumber = 160
+	}
+
+	if c.SummaryMaxAge == 0 {
+		c.SummaryMaxAge = prometheus.DefMaxAge
+	}
+
+	if c.SummaryAgeBuckets == 0 {
+		c.SummaryAgeBuckets = prometheus.DefAgeBuckets
+	}
+
+	if len(c.SizeBuckets) == 0 {
+		c.SizeBuckets = prometheus.ExponentialBuckets(100, 10, 8)
+	}
+
+	if c.HandlerLabelOverflow == "" {
+		c.HandlerLabelOverflow = "other"
+	}
+
+	if c.ClientAbortedCode == 0 {
+		c.ClientAbortedCode = 499
+	}
+
+	return nil
+}
+
+// validateObjectives checks the summary objectives have valid quantiles and
+// absolute errors.
+func validateObjectives(objectives map[float64]float64) error {
+	for q, e := range objectives {
+		if q < 0 || q > 1 {
+			return fmt.Errorf("quantile %v should be between 0 and 1", q)
+		}
+		if e < 0 || e > q || e > 1-q {
+			return fmt.Errorf("absolute error %v of quantile %v is out of range", e, q)
+		}
+	}
+
+	return nil
+}
+
+// validateBuckets checks the buckets are sorted and without duplicates.
+func validateBuckets(buckets []float64) error {
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] == buckets[i-1] {
+			return fmt.Errorf("bucket %v is duplicated", buckets[i])
+		}
+		if buckets[i] < buckets[i-1] {
+			return fmt.Errorf("buckets should be sorted in increasing order")
+		}
+	}
+
+	return nil
 }
 
 // Middleware is a factory that creates middlewares or wrappers that
-// measure requests to the wrapped handler using Prometheus metrics.
+// measure requests to the wrapped handler using Prometheus metrics
+// (or the metrics backend of the Recorder).
 type Middleware interface {
 	// Handler wraps the received handler with the Prometheus middleware.
 	// The first argument receives the handlerID, all the metrics will have
@@ -45,12 +263,13 @@ type Middleware interface {
 	Handler(handlerID string, h http.Handler) http.Handler
 }
 
-// middelware is the prometheus middleware instance.
+// middelware is the middleware instance.
 type middleware struct {
-	httpRequestHistogram *prometheus.HistogramVec
-
-	cfg Config
-	reg prometheus.Registerer
+	rec     Recorder
+	limiter *handlerLimiter
+	labeler *extraLabeler
+	methods *methodLabeler
+	cfg     Config
 }
 
 // NewDefault returns the default Prometheus middleware factory
@@ -61,39 +280,84 @@ func NewDefault() Middleware {
 
 // New returns the a Prometheus middleware factory that will
 // that will wrap the handlers using the customized middleware values.
+// It panics if the configuration is invalid or the metrics can't be
+// registered, use NewWithError to handle these errors.
 func New(cfg Config, reg prometheus.Registerer) Middleware {
+	m, err := NewWithError(cfg, reg)
+	if err != nil {
+		panic(err)
+	}
+
+	return m
+}
+
+// NewWithError is like New but returns an error instead of panicking when the
+// configuration is invalid or the metrics can't be registered. If the metrics
+// are already registered on the registerer by another middleware with the same
+// configuration, the already registered metrics will be reused.
+func NewWithError(cfg Config, reg prometheus.Registerer) (Middleware, error) {
 	// If no registerer then set the default one.
 	if reg == nil {
 		reg = prometheus.DefaultRegisterer
 	}
 
 	// Validate the configuration.
-	cfg.validate()
-
-	// Create our middleware with all the configuration options.
-	m := &middleware{
-		httpRequestHistogram: prometheus.NewHistogramVec(prometheus.HistogramOpts{
-			Namespace: cfg.Prefix,
-			Subsystem: "http",
-			Name:      "request_duration_seconds",
-			Help:      "The latency of the HTTP requests.",
-			Buckets:   cfg.Buckets,
-		}, []string{"handler", "method", "code"}),
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
 
-		cfg: cfg,
-		reg: reg,
+	rec, err := newPrometheusRecorder(cfg, reg)
+	if err != nil {
+		return nil, err
 	}
 
-	// Register all the middleware metrics on prometheus registerer.
-	m.registerMetrics()
+	return newMiddleware(cfg, rec), nil
+}
+
+// NewWithRecorder returns a middleware factory that will wrap the handlers using
+// the customized middleware values and measure using the received Recorder, this
+// way the middleware can be used with metrics backends other than Prometheus.
+// The Prometheus specific configuration options (like the prefix or the buckets)
+// are ignored because they are responsibility of the Recorder.
+// It panics if the configuration is invalid, use NewWithRecorderWithError to handle
+// the error.
+func NewWithRecorder(cfg Config, rec Recorder) Middleware {
+	m, err := NewWithRecorderWithError(cfg, rec)
+	if err != nil {
+		panic(err)
+	}
 
 	return m
 }
 
-func (m *middleware) registerMetrics() {
-	m.reg.MustRegister(
-		m.httpRequestHistogram,
-	)
+// NewWithRecorderWithError is like NewWithRecorder but returns an error instead of
+// panicking when the configuration is invalid.
+func NewWithRecorderWithError(cfg Config, rec Recorder) (Middleware, error) {
+	// Validate the configuration.
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return newMiddleware(cfg, rec), nil
+}
+
+// newMiddleware returns a middleware, the configuration should be already validated.
+func newMiddleware(cfg Config, rec Recorder) *middleware {
+	m := &middleware{
+		rec:     rec,
+		methods: newMethodLabeler(cfg.ExtraMethods, cfg.MethodOverride),
+		cfg:     cfg,
+	}
+
+	if cfg.MaxHandlerLabels > 0 {
+		m.limiter = newHandlerLimiter(cfg.MaxHandlerLabels, cfg.HandlerLabelOverflow)
+	}
+
+	if len(cfg.ExtraLabels) > 0 {
+		m.labeler = newExtraLabeler(cfg.ExtraLabels, cfg.ExtraLabelsExtractor)
+	}
+
+	return m
 }
 
 // Handler satisfies Middlware interface.
@@ -101,48 +365,126 @@ func (m *middleware) Handler(handlerID string, h http.Handler) http.Handler {
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Intercept the writer so we can retrieve data afterwards.
-		wi := &responseWriterInterceptor{
-			statusCode:     http.StatusOK,
-			ResponseWriter: w,
+		wi := newResponseWriterInterceptor(w)
+
+		// Intercept the body so we can know the real size of the request, we
+		// don't rely on the content length because is not set on chunked requests.
+		var bi *bodyInterceptor
+		switch {
+		case r.Body == http.NoBody:
+			// Don't wrap the empty body so the handlers can still know the request
+			// doesn't have a body, it will be measured as empty.
+			bi = &bodyInterceptor{}
+		case r.Body != nil:
+			bi = &bodyInterceptor{ReadCloser: r.Body}
+			r.Body = bi
 		}
 
 		// If there isn't predefined handler ID we
-		// set that ID as the URL path.
+		// set that ID as the (normalized) URL path.
 		hid := handlerID
 		if handlerID == "" {
 			hid = r.URL.Path
+			if m.cfg.PathNormalizer != nil {
+				hid = m.cfg.PathNormalizer.Normalize(hid)
+			}
+			// The path can have escaped bytes that are not valid UTF-8 (e.g `/%ff`),
+			// Prometheus panics with these label values.
+			hid = strings.ToValidUTF8(hid, invalidUTF8Replacement)
 		}
 
+		// Limit the handler label cardinality if required.
+		ctx := r.Context()
+		if m.limiter != nil {
+			var overflow bool
+			if hid, overflow = m.limiter.limit(hid); overflow {
+				m.rec.IncHandlerLabelOverflow(ctx)
+			}
+		}
+
+		// Measure inflight requests.
+		hprops := HTTPProperties{ID: hid}
+		m.rec.AddInflightRequests(ctx, hprops, 1)
+
 		// Start the timer and when finishing measure the duration.
 		start := time.Now()
 		defer func() {
-			duration := time.Since(start).Seconds()
-
-			// If we need to group the status code, it uses the
-			// first number of the status code because is the least
-			// required identification way.
-			var code string
-			if m.cfg.GroupedStatus {
-				code = fmt.Sprintf("%dxx", wi.statusCode/100)
-			} else {
-				code = strconv.Itoa(wi.statusCode)
+			duration := time.Since(start)
+
+			// If the handler panicked the request is measured as an internal error.
+			statusCode := wi.status()
+			rcv := recover()
+			if rcv != nil && rcv != http.ErrAbortHandler {
+				statusCode = http.StatusInternalServerError
+				m.rec.IncPanics(ctx, hprops)
+
+				// Recover writing an internal error response if required and still possible.
+				if m.recoverPanic(rcv) && !wi.headerWritten() {
+					http.Error(wi, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				}
+			} else if rcv == http.ErrAbortHandler || errors.Is(ctx.Err(), context.Canceled) {
+				// The client went away before the handler finished, or the handler aborted the
+				// response (e.g the reverse proxy when the client goes away while copying the body).
+				statusCode = m.cfg.ClientAbortedCode
+				m.rec.IncClientAbortedRequests(ctx, hprops)
 			}
 
-			m.httpRequestHistogram.WithLabelValues(hid, r.Method, code).Observe(duration)
+			m.rec.AddInflightRequests(ctx, hprops, -1)
+
+			props := HTTPReqProperties{
+				ID:     hid,
+				Method: m.methods.methodFor(r),
+				Code:   statusCodeLabel(statusCode, m.cfg.CounterGroupedStatus),
+			}
+			if m.labeler != nil {
+				props.ExtraLabels = m.labeler.labelsFor(r)
+			}
+			m.rec.IncRequests(ctx, props)
+
+			props.Code = statusCodeLabel(statusCode, m.cfg.GroupedStatus)
+			m.rec.ObserveHTTPRequestDuration(ctx, m.withTraceID(r, props), duration)
+
+			// If the handler didn't write anything the response is sent when it returns.
+			ttfb := duration
+			if firstByteAt := wi.firstByte(); !firstByteAt.IsZero() {
+				ttfb = firstByteAt.Sub(start)
+			}
+			m.rec.ObserveHTTPRequestTimeToFirstByte(ctx, props, ttfb)
+			if bi != nil {
+				m.rec.ObserveHTTPRequestSize(ctx, props, bi.bytesRead)
+			}
+			m.rec.ObserveHTTPResponseSize(ctx, props, wi.size())
+
+			// Continue panicking if we don't need to recover.
+			if rcv != nil && !m.recoverPanic(rcv) {
+				panic(rcv)
+			}
 		}()
 
-		h.ServeHTTP(wi, r)
+		h.ServeHTTP(newResponseWriter(wi), r)
 	})
 }
 
-// responseWriterInterceptor is a simple wrapper to incercept set data on a
-// ResponseWriter.
-type responseWriterInterceptor struct {
-	http.ResponseWriter
-	statusCode int
+// statusCodeLabel returns the status code label. If we need to group the status code, it
+// uses the first number of the status code because is the least required identification way.
+func statusCodeLabel(statusCode int, grouped bool) string {
+	if grouped {
+		return fmt.Sprintf("%dxx", statusCode/100)
+	}
+	return strconv.Itoa(statusCode)
+}
+
+// recoverPanic returns true if the middleware needs to recover from the panic. The handler
+// aborts (http.ErrAbortHandler) are never recovered because they are used to abort the response.
+func (m *middleware) recoverPanic(rcv interface{}) bool {
+	return m.cfg.RecoverPanics && rcv != http.ErrAbortHandler
 }
 
-func (w *responseWriterInterceptor) WriteHeader(statusCode int) {
-	w.statusCode = statusCode
-	w.ResponseWriter.WriteHeader(statusCode)
+// withTraceID sets the trace ID of the request on the properties if the trace ID
+// extractor is enabled.
+func (m *middleware) withTraceID(r *http.Request, props HTTPReqProperties) HTTPReqProperties {
+	if m.cfg.TraceIDExtractor != nil {
+		props.TraceID = m.cfg.TraceIDExtractor(r)
+	}
+	return props
 }
@@ -1,21 +1,32 @@
 package middleware_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
 
 	prommiddleware "github.com/slok/go-prometheus-middleware"
 )
 
-func getFakeHandler(statusCode int) http.Handler {
+func getFakeHandler(statusCode int, body string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
 		w.WriteHeader(statusCode)
+		w.Write([]byte(body))
 	})
 }
 
@@ -26,6 +37,7 @@ func TestMiddlewareHandler(t *testing.T) {
 		requests   func(h http.Handler)
 		handlerID  string
 		statusCode int
+		body       string
 		expMetrics []string
 	}{
 		{
@@ -67,6 +79,9 @@ func TestMiddlewareHandler(t *testing.T) {
 				`http_request_duration_seconds_bucket{code="403",handler="/test2",method="POST",le="10"} 1`,
 				`http_request_duration_seconds_bucket{code="403",handler="/test2",method="POST",le="+Inf"} 1`,
 				`http_request_duration_seconds_count{code="403",handler="/test2",method="POST"} 1`,
+
+				`http_request_ttfb_seconds_count{code="403",handler="/test",method="GET"} 1`,
+				`http_request_ttfb_seconds_count{code="403",handler="/test2",method="POST"} 1`,
 			},
 		},
 		{
@@ -111,6 +126,51 @@ func TestMiddlewareHandler(t *testing.T) {
 				`batman_http_request_duration_seconds_count{code="201",handler="bruceWayne",method="POST"} 1`,
 			},
 		},
+		{
+			name:       "default configuration should count the requests.",
+			config:     prommiddleware.Config{},
+			handlerID:  "",
+			statusCode: 404,
+			requests: func(h http.Handler) {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/test", nil))
+			},
+			expMetrics: []string{
+				`http_requests_total{code="404",handler="/test",method="GET"} 2`,
+				`http_requests_total{code="404",handler="/test",method="POST"} 1`,
+			},
+		},
+		{
+			name: "grouped status code should group the code label of the histograms but not the requests counter.",
+			config: prommiddleware.Config{
+				GroupedStatus: true,
+			},
+			handlerID:  "",
+			statusCode: 503,
+			requests: func(h http.Handler) {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+			},
+			expMetrics: []string{
+				`http_request_duration_seconds_count{code="5xx",handler="/test",method="GET"} 1`,
+				`http_requests_total{code="503",handler="/test",method="GET"} 1`,
+			},
+		},
+		{
+			name: "counter grouped status code should group the code label of the requests counter but not the histograms.",
+			config: prommiddleware.Config{
+				CounterGroupedStatus: true,
+			},
+			handlerID:  "",
+			statusCode: 503,
+			requests: func(h http.Handler) {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+			},
+			expMetrics: []string{
+				`http_request_duration_seconds_count{code="503",handler="/test",method="GET"} 1`,
+				`http_requests_total{code="5xx",handler="/test",method="GET"} 1`,
+			},
+		},
 		{
 			name: "default configuration with grouped status code should group the code label.",
 			config: prommiddleware.Config{
@@ -138,6 +198,227 @@ func TestMiddlewareHandler(t *testing.T) {
 				`http_request_duration_seconds_count{code="3xx",handler="/test",method="GET"} 1`,
 			},
 		},
+		{
+			name: "custom size buckets should measure the response size with the bytes written by the handler.",
+			config: prommiddleware.Config{
+				SizeBuckets: []float64{10, 100, 1000},
+			},
+			handlerID:  "",
+			statusCode: 200,
+			body:       "this is a test response of 42 bytes long!!",
+			requests: func(h http.Handler) {
+				r := httptest.NewRequest("GET", "/test", nil)
+				h.ServeHTTP(httptest.NewRecorder(), r)
+				h.ServeHTTP(httptest.NewRecorder(), r)
+			},
+			expMetrics: []string{
+				`http_response_size_bytes_bucket{code="200",handler="/test",method="GET",le="10"} 0`,
+				`http_response_size_bytes_bucket{code="200",handler="/test",method="GET",le="100"} 2`,
+				`http_response_size_bytes_bucket{code="200",handler="/test",method="GET",le="1000"} 2`,
+				`http_response_size_bytes_bucket{code="200",handler="/test",method="GET",le="+Inf"} 2`,
+				`http_response_size_bytes_sum{code="200",handler="/test",method="GET"} 84`,
+				`http_response_size_bytes_count{code="200",handler="/test",method="GET"} 2`,
+			},
+		},
+		{
+			name: "custom size buckets should measure the request size with the bytes read from the body instead of the content length.",
+			config: prommiddleware.Config{
+				SizeBuckets: []float64{10, 100, 1000},
+			},
+			handlerID:  "",
+			statusCode: 202,
+			requests: func(h http.Handler) {
+				r := httptest.NewRequest("POST", "/upload", strings.NewReader(strings.Repeat("a", 500)))
+				r.ContentLength = -1 // Simulate a chunked request.
+				r2 := httptest.NewRequest("POST", "/upload", strings.NewReader(strings.Repeat("a", 50)))
+				h.ServeHTTP(httptest.NewRecorder(), r)
+				h.ServeHTTP(httptest.NewRecorder(), r2)
+			},
+			expMetrics: []string{
+				`http_request_size_bytes_bucket{code="202",handler="/upload",method="POST",le="10"} 0`,
+				`http_request_size_bytes_bucket{code="202",handler="/upload",method="POST",le="100"} 1`,
+				`http_request_size_bytes_bucket{code="202",handler="/upload",method="POST",le="1000"} 2`,
+				`http_request_size_bytes_bucket{code="202",handler="/upload",method="POST",le="+Inf"} 2`,
+				`http_request_size_bytes_sum{code="202",handler="/upload",method="POST"} 550`,
+				`http_request_size_bytes_count{code="202",handler="/upload",method="POST"} 2`,
+			},
+		},
+		{
+			name:       "default configuration with a URL path that is not valid UTF-8 should measure with the invalid bytes replaced.",
+			config:     prommiddleware.Config{},
+			handlerID:  "",
+			statusCode: 200,
+			requests: func(h http.Handler) {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/%ff%fe", nil))
+			},
+			expMetrics: []string{
+				"http_request_duration_seconds_count{code=\"200\",handler=\"/\uFFFD\",method=\"GET\"} 1",
+				"http_requests_inflight{handler=\"/\uFFFD\"} 0",
+			},
+		},
+		{
+			name: "default configuration with path normalizer should normalize the URL inferred handler.",
+			config: prommiddleware.Config{
+				PathNormalizer: prommiddleware.DefaultPathNormalizer,
+			},
+			handlerID:  "",
+			statusCode: 200,
+			requests: func(h http.Handler) {
+				r := httptest.NewRequest("GET", "/users/123", nil)
+				r2 := httptest.NewRequest("GET", "/users/456", nil)
+				h.ServeHTTP(httptest.NewRecorder(), r)
+				h.ServeHTTP(httptest.NewRecorder(), r2)
+			},
+			expMetrics: []string{
+				`http_request_duration_seconds_count{code="200",handler="/users/:id",method="GET"} 2`,
+			},
+		},
+		{
+			name: "custom configuration with handlerID and path normalizer shouldn't normalize the handler.",
+			config: prommiddleware.Config{
+				PathNormalizer: prommiddleware.DefaultPathNormalizer,
+			},
+			handlerID:  "/users/123",
+			statusCode: 200,
+			requests: func(h http.Handler) {
+				r := httptest.NewRequest("GET", "/users/456", nil)
+				h.ServeHTTP(httptest.NewRecorder(), r)
+			},
+			expMetrics: []string{
+				`http_request_duration_seconds_count{code="200",handler="/users/123",method="GET"} 1`,
+			},
+		},
+		{
+			name: "custom configuration with extra labels should measure with the allowed extra labels values.",
+			config: prommiddleware.Config{
+				ExtraLabels: []prommiddleware.ExtraLabel{
+					{Name: "tenant", AllowedValues: []string{"wayne-enterprises", "daily-planet"}},
+					{Name: "api_version", AllowedValues: []string{"v1", "v2"}, Fallback: "unknown"},
+					{Name: "client_app"},
+				},
+				ExtraLabelsExtractor: func(r *http.Request) []string {
+					return []string{r.Header.Get("X-Tenant"), r.Header.Get("X-Api-Version"), r.Header.Get("X-Client-App")}
+				},
+			},
+			handlerID:  "test",
+			statusCode: 200,
+			requests: func(h http.Handler) {
+				r := httptest.NewRequest("GET", "/test", nil)
+				r.Header.Set("X-Tenant", "wayne-enterprises")
+				r.Header.Set("X-Api-Version", "v2")
+				r.Header.Set("X-Client-App", "batmobile")
+				r2 := httptest.NewRequest("GET", "/test", nil)
+				r2.Header.Set("X-Tenant", "joker-inc")
+				r2.Header.Set("X-Api-Version", "v3")
+				r2.Header.Set("X-Client-App", "ios")
+				h.ServeHTTP(httptest.NewRecorder(), r)
+				h.ServeHTTP(httptest.NewRecorder(), r2)
+			},
+			expMetrics: []string{
+				`http_request_duration_seconds_count{api_version="v2",client_app="batmobile",code="200",handler="test",method="GET",tenant="wayne-enterprises"} 1`,
+				`http_request_duration_seconds_count{api_version="unknown",client_app="ios",code="200",handler="test",method="GET",tenant="other"} 1`,
+				`http_request_size_bytes_count{api_version="v2",client_app="batmobile",code="200",handler="test",method="GET",tenant="wayne-enterprises"} 1`,
+				`http_response_size_bytes_count{api_version="unknown",client_app="ios",code="200",handler="test",method="GET",tenant="other"} 1`,
+				`http_requests_inflight{handler="test"} 0`,
+			},
+		},
+		{
+			name: "custom configuration with extra labels and an extractor that returns missing values should measure with the fallback values.",
+			config: prommiddleware.Config{
+				ExtraLabels: []prommiddleware.ExtraLabel{
+					{Name: "tenant"},
+					{Name: "api_version"},
+				},
+				ExtraLabelsExtractor: func(r *http.Request) []string {
+					return []string{"wayne-enterprises"}
+				},
+			},
+			handlerID:  "test",
+			statusCode: 200,
+			requests: func(h http.Handler) {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+			},
+			expMetrics: []string{
+				`http_request_duration_seconds_count{api_version="other",code="200",handler="test",method="GET",tenant="wayne-enterprises"} 1`,
+			},
+		},
+		{
+			name: "custom configuration with extra labels and values that are not valid UTF-8 should measure with the fallback values.",
+			config: prommiddleware.Config{
+				ExtraLabels: []prommiddleware.ExtraLabel{
+					{Name: "client_app", Fallback: "unknown"},
+				},
+				ExtraLabelsExtractor: func(r *http.Request) []string {
+					return []string{r.Header.Get("X-Client-App")}
+				},
+			},
+			handlerID:  "test",
+			statusCode: 200,
+			requests: func(h http.Handler) {
+				r := httptest.NewRequest("GET", "/test", nil)
+				r.Header.Set("X-Client-App", "\xff\xfe")
+				h.ServeHTTP(httptest.NewRecorder(), r)
+			},
+			expMetrics: []string{
+				`http_request_duration_seconds_count{client_app="unknown",code="200",handler="test",method="GET"} 1`,
+			},
+		},
+		{
+			name:       "default configuration should measure the unknown methods as other.",
+			config:     prommiddleware.Config{},
+			handlerID:  "test",
+			statusCode: 200,
+			requests: func(h http.Handler) {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PATCH", "/test", nil))
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("FOOBAR", "/test", nil))
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PROPFIND", "/test", nil))
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("get", "/test", nil))
+			},
+			expMetrics: []string{
+				`http_request_duration_seconds_count{code="200",handler="test",method="PATCH"} 1`,
+				`http_request_duration_seconds_count{code="200",handler="test",method="other"} 3`,
+			},
+		},
+		{
+			name: "custom configuration with extra methods should measure the extra methods.",
+			config: prommiddleware.Config{
+				ExtraMethods: []string{"PROPFIND", "MKCOL"},
+			},
+			handlerID:  "test",
+			statusCode: 200,
+			requests: func(h http.Handler) {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PROPFIND", "/test", nil))
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("FOOBAR", "/test", nil))
+			},
+			expMetrics: []string{
+				`http_request_duration_seconds_count{code="200",handler="test",method="PROPFIND"} 1`,
+				`http_request_duration_seconds_count{code="200",handler="test",method="other"} 1`,
+			},
+		},
+		{
+			name: "custom configuration with method override should measure the overridden method of POST requests.",
+			config: prommiddleware.Config{
+				MethodOverride: true,
+			},
+			handlerID:  "test",
+			statusCode: 200,
+			requests: func(h http.Handler) {
+				r := httptest.NewRequest("POST", "/test", nil)
+				r.Header.Set("X-HTTP-Method-Override", "DELETE")
+				r2 := httptest.NewRequest("POST", "/test", nil)
+				r2.Header.Set("X-HTTP-Method-Override", "FOOBAR")
+				r3 := httptest.NewRequest("GET", "/test", nil)
+				r3.Header.Set("X-HTTP-Method-Override", "PUT")
+				h.ServeHTTP(httptest.NewRecorder(), r)
+				h.ServeHTTP(httptest.NewRecorder(), r2)
+				h.ServeHTTP(httptest.NewRecorder(), r3)
+			},
+			expMetrics: []string{
+				`http_request_duration_seconds_count{code="200",handler="test",method="DELETE"} 1`,
+				`http_request_duration_seconds_count{code="200",handler="test",method="other"} 1`,
+				`http_request_duration_seconds_count{code="200",handler="test",method="GET"} 1`,
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -146,7 +427,7 @@ func TestMiddlewareHandler(t *testing.T) {
 
 			reg := prometheus.NewRegistry()
 			m := prommiddleware.New(test.config, reg)
-			h := m.Handler(test.handlerID, getFakeHandler(test.statusCode))
+			h := m.Handler(test.handlerID, getFakeHandler(test.statusCode, test.body))
 
 			// Make the calls to our handler.
 			test.requests(h)
@@ -169,6 +450,1067 @@ func TestMiddlewareHandler(t *testing.T) {
 	}
 }
 
+func getMetrics(reg prometheus.Gatherer) string {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(rec, req)
+	body, _ := ioutil.ReadAll(rec.Result().Body)
+	return string(body)
+}
+
+func TestNewWithError(t *testing.T) {
+	tests := []struct {
+		name   string
+		config prommiddleware.Config
+		reg    func() *prometheus.Registry
+		expErr bool
+	}{
+		{
+			name:   "A default configuration shouldn't fail.",
+			config: prommiddleware.Config{},
+			expErr: false,
+		},
+		{
+			name: "A custom valid configuration shouldn't fail.",
+			config: prommiddleware.Config{
+				Prefix:      "batman_robin:test",
+				Buckets:     []float64{.1, .5, 1},
+				SizeBuckets: []float64{10, 100, 1000},
+			},
+			expErr: false,
+		},
+		{
+			name:   "A prefix with invalid characters should fail.",
+			config: prommiddleware.Config{Prefix: "batman-robin"},
+			expErr: true,
+		},
+		{
+			name:   "A prefix starting with a number should fail.",
+			config: prommiddleware.Config{Prefix: "1batman"},
+			expErr: true,
+		},
+		{
+			name:   "Unsorted buckets should fail.",
+			config: prommiddleware.Config{Buckets: []float64{.1, 1, .5}},
+			expErr: true,
+		},
+		{
+			name:   "Duplicated buckets should fail.",
+			config: prommiddleware.Config{Buckets: []float64{.1, .5, .5, 1}},
+			expErr: true,
+		},
+		{
+			name:   "Unsorted size buckets should fail.",
+			config: prommiddleware.Config{SizeBuckets: []float64{100, 10}},
+			expErr: true,
+		},
+		{
+			name:   "A negative handler label limit should fail.",
+			config: prommiddleware.Config{MaxHandlerLabels: -1},
+			expErr: true,
+		},
+		{
+			name:   "A native histogram bucket factor lower than 1 should fail.",
+			config: prommiddleware.Config{NativeHistogramBucketFactor: 0.5},
+			expErr: true,
+		},
+		{
+			name:   "A negative native histogram zero threshold should fail.",
+			config: prommiddleware.Config{NativeHistogramBucketFactor: 1.1, NativeHistogramZeroThreshold: -1},
+			expErr: true,
+		},
+		{
+			name:   "An invalid summary objective quantile should fail.",
+			config: prommiddleware.Config{SummaryObjectives: map[float64]float64{1.5: 0.01}},
+			expErr: true,
+		},
+		{
+			name:   "An invalid summary objective error should fail.",
+			config: prommiddleware.Config{SummaryObjectives: map[float64]float64{0.99: 0.1}},
+			expErr: true,
+		},
+		{
+			name:   "Summary only without objectives should fail.",
+			config: prommiddleware.Config{SummaryOnly: true},
+			expErr: true,
+		},
+		{
+			name:   "An invalid client aborted status code should fail.",
+			config: prommiddleware.Config{ClientAbortedCode: 1000},
+			expErr: true,
+		},
+		{
+			name: "Extra labels without extractor should fail.",
+			config: prommiddleware.Config{
+				ExtraLabels: []prommiddleware.ExtraLabel{{Name: "tenant"}},
+			},
+			expErr: true,
+		},
+		{
+			name: "Extra labels with invalid names should fail.",
+			config: prommiddleware.Config{
+				ExtraLabels:          []prommiddleware.ExtraLabel{{Name: "api-version"}},
+				ExtraLabelsExtractor: func(r *http.Request) []string { return nil },
+			},
+			expErr: true,
+		},
+		{
+			name: "Extra labels with reserved names should fail.",
+			config: prommiddleware.Config{
+				ExtraLabels:          []prommiddleware.ExtraLabel{{Name: "handler"}},
+				ExtraLabelsExtractor: func(r *http.Request) []string { return nil },
+			},
+			expErr: true,
+		},
+		{
+			name: "Extra labels with a fallback that is not valid UTF-8 should fail.",
+			config: prommiddleware.Config{
+				ExtraLabels:          []prommiddleware.ExtraLabel{{Name: "tenant", Fallback: "\xff"}},
+				ExtraLabelsExtractor: func(r *http.Request) []string { return nil },
+			},
+			expErr: true,
+		},
+		{
+			name: "Extra labels with the quantile name and summary objectives should fail.",
+			config: prommiddleware.Config{
+				SummaryObjectives:    map[float64]float64{0.5: 0.05},
+				ExtraLabels:          []prommiddleware.ExtraLabel{{Name: "quantile"}},
+				ExtraLabelsExtractor: func(r *http.Request) []string { return nil },
+			},
+			expErr: true,
+		},
+		{
+			name: "Duplicated extra labels should fail.",
+			config: prommiddleware.Config{
+				ExtraLabels:          []prommiddleware.ExtraLabel{{Name: "tenant"}, {Name: "tenant"}},
+				ExtraLabelsExtractor: func(r *http.Request) []string { return nil },
+			},
+			expErr: true,
+		},
+		{
+			name:   "Already registered compatible metrics should be reused.",
+			config: prommiddleware.Config{},
+			reg: func() *prometheus.Registry {
+				reg := prometheus.NewRegistry()
+				prommiddleware.New(prommiddleware.Config{}, reg)
+				return reg
+			},
+			expErr: false,
+		},
+		{
+			name:   "Already registered metrics with different buckets should fail.",
+			config: prommiddleware.Config{Buckets: []float64{10, 20, 30}},
+			reg: func() *prometheus.Registry {
+				reg := prometheus.NewRegistry()
+				prommiddleware.New(prommiddleware.Config{Buckets: []float64{1, 2}}, reg)
+				return reg
+			},
+			expErr: true,
+		},
+		{
+			name:   "Already registered metrics with different summary objectives should fail.",
+			config: prommiddleware.Config{SummaryObjectives: map[float64]float64{0.99: 0.001}},
+			reg: func() *prometheus.Registry {
+				reg := prometheus.NewRegistry()
+				prommiddleware.New(prommiddleware.Config{SummaryObjectives: map[float64]float64{0.5: 0.05}}, reg)
+				return reg
+			},
+			expErr: true,
+		},
+		{
+			name:   "Already registered incompatible metrics should fail.",
+			config: prommiddleware.Config{},
+			reg: func() *prometheus.Registry {
+				reg := prometheus.NewRegistry()
+				reg.MustRegister(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+					Name: "http_request_duration_seconds",
+					Help: "The latency of the HTTP requests.",
+				}, []string{"handler"}))
+				return reg
+			},
+			expErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			reg := prometheus.NewRegistry()
+			if test.reg != nil {
+				reg = test.reg()
+			}
+
+			var m prommiddleware.Middleware
+			var err error
+			assert.NotPanics(func() { m, err = prommiddleware.NewWithError(test.config, reg) })
+			if test.expErr {
+				assert.Error(err)
+				assert.Panics(func() { prommiddleware.New(test.config, reg) })
+			} else if assert.NoError(err) {
+				assert.NotNil(m)
+			}
+		})
+	}
+}
+
+func TestNewReusesRegisteredMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	reg := prometheus.NewRegistry()
+	m1, err := prommiddleware.NewWithError(prommiddleware.Config{Prefix: "batman"}, reg)
+	assert.NoError(err)
+	m2, err := prommiddleware.NewWithError(prommiddleware.Config{Prefix: "batman"}, reg)
+	assert.NoError(err)
+
+	// Both middlewares should measure on the same metrics.
+	m1.Handler("test", getFakeHandler(200, "")).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	m2.Handler("test", getFakeHandler(200, "")).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	assert.Contains(getMetrics(reg), `batman_http_request_duration_seconds_count{code="200",handler="test",method="GET"} 2`)
+}
+
+func TestNewWithErrorUnregistersMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	// The TTFB histogram registration will fail after registering other metrics.
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "http_request_ttfb_seconds",
+		Help: "The latency of the HTTP requests until the first byte of the response is written.",
+	}))
+
+	_, err := prommiddleware.NewWithError(prommiddleware.Config{}, reg)
+	assert.Error(err)
+
+	// The metrics registered before the failure shouldn't be on the registry.
+	err = reg.Register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "The number of HTTP requests.",
+	}, []string{"handler", "method", "code"}))
+	assert.NoError(err)
+}
+
+func TestNewWithRecorderWithError(t *testing.T) {
+	tests := []struct {
+		name   string
+		config prommiddleware.Config
+		expErr bool
+	}{
+		{
+			name:   "A default configuration shouldn't fail.",
+			config: prommiddleware.Config{},
+			expErr: false,
+		},
+		{
+			name:   "An invalid configuration should fail.",
+			config: prommiddleware.Config{MaxHandlerLabels: -1},
+			expErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			m, err := prommiddleware.NewWithRecorderWithError(test.config, newFakeRecorder())
+			if test.expErr {
+				assert.Error(err)
+				assert.Panics(func() { prommiddleware.NewWithRecorder(test.config, newFakeRecorder()) })
+			} else if assert.NoError(err) {
+				assert.NotNil(m)
+			}
+		})
+	}
+}
+
+func TestMiddlewareInflightRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	reg := prometheus.NewRegistry()
+	m := prommiddleware.New(prommiddleware.Config{}, reg)
+
+	// Block the handlers until we have checked the inflight requests.
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	h := m.Handler("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-finish
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+		}()
+		<-started
+	}
+
+	assert.Contains(getMetrics(reg), `http_requests_inflight{handler="test"} 3`)
+
+	close(finish)
+	wg.Wait()
+
+	assert.Contains(getMetrics(reg), `http_requests_inflight{handler="test"} 0`)
+}
+
+func getOpenMetrics(reg prometheus.Gatherer) string {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text")
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{EnableOpenMetrics: true}).ServeHTTP(rec, req)
+	body, _ := ioutil.ReadAll(rec.Result().Body)
+	return string(body)
+}
+
+func TestMiddlewareRequestNoBody(t *testing.T) {
+	assert := assert.New(t)
+
+	reg := prometheus.NewRegistry()
+	m := prommiddleware.New(prommiddleware.Config{}, reg)
+
+	var noBody bool
+	h := m.Handler("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		noBody = r.Body == http.NoBody
+	}))
+	r := httptest.NewRequest("POST", "/test", nil)
+	r.Body = http.NoBody
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	// The empty body shouldn't be wrapped and should be measured as empty.
+	assert.True(noBody)
+	metrics := getMetrics(reg)
+	assert.Contains(metrics, `http_request_size_bytes_sum{code="200",handler="test",method="POST"} 0`)
+	assert.Contains(metrics, `http_request_size_bytes_count{code="200",handler="test",method="POST"} 1`)
+}
+
+func TestMiddlewareExemplars(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+
+	tests := []struct {
+		name          string
+		config        prommiddleware.Config
+		request       func() *http.Request
+		expMetrics    []string
+		expNotMetrics []string
+	}{
+		{
+			name:   "Without trace ID extractor shouldn't measure with exemplars.",
+			config: prommiddleware.Config{},
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "/test", nil)
+				r.Header.Set("X-Trace-Id", "1234567890")
+				return r
+			},
+			expNotMetrics: []string{
+				`trace_id`,
+			},
+		},
+		{
+			name: "With a custom trace ID extractor should measure with the trace ID exemplar.",
+			config: prommiddleware.Config{
+				TraceIDExtractor: func(r *http.Request) string { return r.Header.Get("X-Trace-Id") },
+			},
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "/test", nil)
+				r.Header.Set("X-Trace-Id", "1234567890")
+				return r
+			},
+			expMetrics: []string{
+				`http_request_duration_seconds_bucket{code="200",handler="test",method="GET",le="0.005"} 1 # {trace_id="1234567890"}`,
+			},
+		},
+		{
+			name: "With a trace ID longer than the exemplar limit shouldn't measure with exemplars.",
+			config: prommiddleware.Config{
+				TraceIDExtractor: func(r *http.Request) string { return r.Header.Get("X-Trace-Id") },
+			},
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "/test", nil)
+				r.Header.Set("X-Trace-Id", strings.Repeat("a", 200))
+				return r
+			},
+			expMetrics: []string{
+				`http_request_duration_seconds_bucket{code="200",handler="test",method="GET",le="0.005"} 1`,
+			},
+			expNotMetrics: []string{
+				`trace_id`,
+			},
+		},
+		{
+			name: "With a trace ID that is not valid UTF-8 shouldn't measure with exemplars.",
+			config: prommiddleware.Config{
+				TraceIDExtractor: func(r *http.Request) string { return r.Header.Get("X-Trace-Id") },
+			},
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "/test", nil)
+				r.Header.Set("X-Trace-Id", "\xff\xfe")
+				return r
+			},
+			expMetrics: []string{
+				`http_request_duration_seconds_bucket{code="200",handler="test",method="GET",le="0.005"} 1`,
+			},
+			expNotMetrics: []string{
+				`trace_id`,
+			},
+		},
+		{
+			name: "With the OpenTelemetry trace ID extractor and a sampled trace should measure with the trace ID exemplar.",
+			config: prommiddleware.Config{
+				TraceIDExtractor: prommiddleware.OTelTraceID,
+			},
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "/test", nil)
+				sc := trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID, TraceFlags: trace.FlagsSampled})
+				return r.WithContext(trace.ContextWithSpanContext(r.Context(), sc))
+			},
+			expMetrics: []string{
+				`http_request_duration_seconds_bucket{code="200",handler="test",method="GET",le="0.005"} 1 # {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"}`,
+			},
+		},
+		{
+			name: "With the OpenTelemetry trace ID extractor and a not sampled trace shouldn't measure with exemplars.",
+			config: prommiddleware.Config{
+				TraceIDExtractor: prommiddleware.OTelTraceID,
+			},
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "/test", nil)
+				sc := trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID})
+				return r.WithContext(trace.ContextWithSpanContext(r.Context(), sc))
+			},
+			expNotMetrics: []string{
+				`trace_id`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			reg := prometheus.NewRegistry()
+			m := prommiddleware.New(test.config, reg)
+			h := m.Handler("test", getFakeHandler(200, ""))
+			h.ServeHTTP(httptest.NewRecorder(), test.request())
+
+			metrics := getOpenMetrics(reg)
+			for _, expMetric := range test.expMetrics {
+				assert.Contains(metrics, expMetric)
+			}
+			for _, expNotMetric := range test.expNotMetrics {
+				assert.NotContains(metrics, expNotMetric)
+			}
+		})
+	}
+}
+
+// fakeRecorder is a Recorder that stores the measurements.
+type fakeRecorder struct {
+	mu        sync.Mutex
+	requests  []prommiddleware.HTTPReqProperties
+	durations []prommiddleware.HTTPReqProperties
+	ttfbs     map[string]time.Duration
+	reqSizes  map[string]int64
+	respSizes map[string]int64
+	inflights map[string]int
+	panics    map[string]int
+	aborts    map[string]int
+	overflows int
+}
+
+func newFakeRecorder() *fakeRecorder {
+	return &fakeRecorder{
+		ttfbs:     map[string]time.Duration{},
+		reqSizes:  map[string]int64{},
+		respSizes: map[string]int64{},
+		inflights: map[string]int{},
+		panics:    map[string]int{},
+		aborts:    map[string]int{},
+	}
+}
+
+func (f *fakeRecorder) IncRequests(_ context.Context, p prommiddleware.HTTPReqProperties) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, p)
+}
+
+func (f *fakeRecorder) ObserveHTTPRequestDuration(_ context.Context, p prommiddleware.HTTPReqProperties, _ time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.durations = append(f.durations, p)
+}
+
+func (f *fakeRecorder) ObserveHTTPRequestTimeToFirstByte(_ context.Context, p prommiddleware.HTTPReqProperties, duration time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ttfbs[p.ID] = duration
+}
+
+func (f *fakeRecorder) ObserveHTTPRequestSize(_ context.Context, p prommiddleware.HTTPReqProperties, sizeBytes int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reqSizes[p.ID] += sizeBytes
+}
+
+func (f *fakeRecorder) ObserveHTTPResponseSize(_ context.Context, p prommiddleware.HTTPReqProperties, sizeBytes int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.respSizes[p.ID] += sizeBytes
+}
+
+func (f *fakeRecorder) AddInflightRequests(_ context.Context, p prommiddleware.HTTPProperties, quantity int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inflights[p.ID] += quantity
+}
+
+func (f *fakeRecorder) IncPanics(_ context.Context, p prommiddleware.HTTPProperties) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.panics[p.ID]++
+}
+
+func (f *fakeRecorder) IncClientAbortedRequests(_ context.Context, p prommiddleware.HTTPProperties) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.aborts[p.ID]++
+}
+
+func (f *fakeRecorder) IncHandlerLabelOverflow(_ context.Context) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.overflows++
+}
+
+func TestMiddlewareHandlerRecorder(t *testing.T) {
+	assert := assert.New(t)
+
+	rec := newFakeRecorder()
+	m := prommiddleware.NewWithRecorder(prommiddleware.Config{GroupedStatus: true}, rec)
+	h := m.Handler("", getFakeHandler(404, "not found"))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/test", strings.NewReader("test")))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/test", strings.NewReader("test2")))
+
+	expProps := prommiddleware.HTTPReqProperties{ID: "/test", Method: "PUT", Code: "4xx"}
+	expCounterProps := prommiddleware.HTTPReqProperties{ID: "/test", Method: "PUT", Code: "404"}
+	assert.Equal([]prommiddleware.HTTPReqProperties{expCounterProps, expCounterProps}, rec.requests)
+	assert.Equal([]prommiddleware.HTTPReqProperties{expProps, expProps}, rec.durations)
+	assert.Equal(int64(9), rec.reqSizes["/test"])
+	assert.Equal(int64(18), rec.respSizes["/test"])
+	assert.Equal(0, rec.inflights["/test"])
+}
+
+func TestMiddlewareTimeToFirstByte(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		expMin  time.Duration
+		expMax  time.Duration
+	}{
+		{
+			name: "A streaming handler should measure until the headers are sent.",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				time.Sleep(200 * time.Millisecond)
+				w.Write([]byte("test"))
+			},
+			expMin: 0,
+			expMax: 200 * time.Millisecond,
+		},
+		{
+			name: "A slow handler should measure until the first write.",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(50 * time.Millisecond)
+				w.Write([]byte("test"))
+			},
+			expMin: 50 * time.Millisecond,
+			expMax: time.Minute,
+		},
+		{
+			name: "A handler that flushes should measure until the flush.",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.(http.Flusher).Flush()
+				time.Sleep(200 * time.Millisecond)
+			},
+			expMin: 0,
+			expMax: 200 * time.Millisecond,
+		},
+		{
+			name: "A handler that doesn't write should measure until it returns.",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(50 * time.Millisecond)
+			},
+			expMin: 50 * time.Millisecond,
+			expMax: time.Minute,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			rec := newFakeRecorder()
+			m := prommiddleware.NewWithRecorder(prommiddleware.Config{}, rec)
+			h := m.Handler("test", test.handler)
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+
+			ttfb := rec.ttfbs["test"]
+			assert.GreaterOrEqual(ttfb, test.expMin)
+			assert.Less(ttfb, test.expMax)
+		})
+	}
+}
+
+func TestMiddlewareHandlerLabelLimit(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       prommiddleware.Config
+		requests     int
+		expHandlers  []string
+		expOverflows int
+	}{
+		{
+			name:        "Without limit all the handlers should be measured.",
+			config:      prommiddleware.Config{},
+			requests:    10,
+			expHandlers: []string{"/0", "/1", "/2", "/3", "/4", "/5", "/6", "/7", "/8", "/9"},
+		},
+		{
+			name: "With a limit, the handlers after the limit should be measured with the default overflow handler.",
+			config: prommiddleware.Config{
+				MaxHandlerLabels: 3,
+			},
+			requests:     10,
+			expHandlers:  []string{"/0", "/1", "/2", "other"},
+			expOverflows: 7,
+		},
+		{
+			name: "With a limit and a custom overflow handler, the handlers after the limit should be measured with the custom overflow handler.",
+			config: prommiddleware.Config{
+				MaxHandlerLabels:     5,
+				HandlerLabelOverflow: "overflow",
+			},
+			requests:     6,
+			expHandlers:  []string{"/0", "/1", "/2", "/3", "/4", "overflow"},
+			expOverflows: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			rec := newFakeRecorder()
+			m := prommiddleware.NewWithRecorder(test.config, rec)
+			h := m.Handler("", getFakeHandler(200, ""))
+
+			for i := 0; i < test.requests; i++ {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", fmt.Sprintf("/%d", i), nil))
+				// Already known handlers should be measured with their own label.
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/0", nil))
+			}
+
+			var gotHandlers []string
+			for id := range rec.inflights {
+				gotHandlers = append(gotHandlers, id)
+			}
+			assert.ElementsMatch(test.expHandlers, gotHandlers)
+			assert.Equal(test.expOverflows, rec.overflows)
+		})
+	}
+}
+
+func TestMiddlewareHandlerLabelLimitConcurrency(t *testing.T) {
+	assert := assert.New(t)
+
+	reg := prometheus.NewRegistry()
+	m := prommiddleware.New(prommiddleware.Config{MaxHandlerLabels: 10}, reg)
+	h := m.Handler("", getFakeHandler(200, ""))
+
+	// Make lots of concurrent requests to random URLs.
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", fmt.Sprintf("/%d/%d", i, j), nil))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	mfs, err := reg.Gather()
+	assert.NoError(err)
+	metrics := map[string]*dto.MetricFamily{}
+	for _, mf := range mfs {
+		metrics[mf.GetName()] = mf
+	}
+
+	// The limited handlers plus the overflow one.
+	assert.Len(metrics["http_request_duration_seconds"].GetMetric(), 11)
+	assert.Equal(float64(1000-10), metrics["http_handler_label_overflow_total"].GetMetric()[0].GetCounter().GetValue())
+}
+
+func TestMiddlewareNativeHistograms(t *testing.T) {
+	tests := []struct {
+		name             string
+		config           prommiddleware.Config
+		expNative        bool
+		expSchema        int32
+		expZeroThreshold float64
+		expBuckets       int
+	}{
+		{
+			name:       "The default configuration should measure the latency with classic histograms.",
+			config:     prommiddleware.Config{},
+			expNative:  false,
+			expBuckets: 11,
+		},
+		{
+			name: "Native histograms should measure the latency without classic buckets.",
+			config: prommiddleware.Config{
+				NativeHistogramBucketFactor: 1.1,
+			},
+			expNative:        true,
+			expSchema:        3,
+			expZeroThreshold: prometheus.DefNativeHistogramZeroThreshold,
+			expBuckets:       0,
+		},
+		{
+			name: "Native histograms with classic buckets should measure the latency with both.",
+			config: prommiddleware.Config{
+				Buckets:                           []float64{.1, .5, 1},
+				NativeHistogramBucketFactor:       1.1,
+				NativeHistogramZeroThreshold:      0.001,
+				NativeHistogramWithClassicBuckets: true,
+			},
+			expNative:        true,
+			expSchema:        3,
+			expZeroThreshold: 0.001,
+			expBuckets:       3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			reg := prometheus.NewRegistry()
+			m := prommiddleware.New(test.config, reg)
+			h := m.Handler("test", getFakeHandler(200, "test"))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+
+			mfs, err := reg.Gather()
+			require.NoError(err)
+			metrics := map[string]*dto.MetricFamily{}
+			for _, mf := range mfs {
+				metrics[mf.GetName()] = mf
+			}
+
+			for _, name := range []string{"http_request_duration_seconds", "http_request_ttfb_seconds"} {
+				require.Contains(metrics, name)
+				hist := metrics[name].GetMetric()[0].GetHistogram()
+				assert.Equal(uint64(1), hist.GetSampleCount())
+				assert.Len(hist.GetBucket(), test.expBuckets)
+				if test.expNative {
+					require.NotNil(hist.Schema)
+					assert.Equal(test.expSchema, hist.GetSchema())
+					assert.Equal(test.expZeroThreshold, hist.GetZeroThreshold())
+				} else {
+					assert.Nil(hist.Schema)
+				}
+			}
+
+			// The size histograms are not affected.
+			assert.Nil(metrics["http_response_size_bytes"].GetMetric()[0].GetHistogram().Schema)
+		})
+	}
+}
+
+func TestMiddlewareSummary(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        prommiddleware.Config
+		expMetrics    []string
+		expNotMetrics []string
+	}{
+		{
+			name: "Summary objectives should measure the latency with a summary besides the histogram.",
+			config: prommiddleware.Config{
+				SummaryObjectives: map[float64]float64{0.5: 0.05, 0.99: 0.001},
+			},
+			expMetrics: []string{
+				`# TYPE http_request_duration_seconds histogram`,
+				`http_request_duration_seconds_count{code="200",handler="test",method="GET"} 2`,
+				`# TYPE http_request_summary_duration_seconds summary`,
+				`http_request_summary_duration_seconds{code="200",handler="test",method="GET",quantile="0.5"}`,
+				`http_request_summary_duration_seconds{code="200",handler="test",method="GET",quantile="0.99"}`,
+				`http_request_summary_duration_seconds_count{code="200",handler="test",method="GET"} 2`,
+			},
+		},
+		{
+			name: "Summary only should measure the latency with a summary instead of the histogram.",
+			config: prommiddleware.Config{
+				Prefix:            "batman",
+				SummaryObjectives: map[float64]float64{0.9: 0.01},
+				SummaryOnly:       true,
+			},
+			expMetrics: []string{
+				`# TYPE batman_http_request_duration_seconds summary`,
+				`batman_http_request_duration_seconds{code="200",handler="test",method="GET",quantile="0.9"}`,
+				`batman_http_request_duration_seconds_count{code="200",handler="test",method="GET"} 2`,
+				`batman_http_request_ttfb_seconds_count{code="200",handler="test",method="GET"} 2`,
+			},
+			expNotMetrics: []string{
+				`batman_http_request_duration_seconds_bucket`,
+				`batman_http_request_summary_duration_seconds`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			reg := prometheus.NewRegistry()
+			m := prommiddleware.New(test.config, reg)
+			h := m.Handler("test", getFakeHandler(200, "test"))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+
+			metrics := getMetrics(reg)
+			for _, expMetric := range test.expMetrics {
+				assert.Contains(metrics, expMetric)
+			}
+			for _, expNotMetric := range test.expNotMetrics {
+				assert.NotContains(metrics, expNotMetric)
+			}
+		})
+	}
+}
+
+func TestMiddlewarePanics(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        prommiddleware.Config
+		handler       http.HandlerFunc
+		expPanic      bool
+		expRespCode   int
+		expRespBody   string
+		expMetrics    []string
+		expNotMetrics []string
+	}{
+		{
+			name:   "A panicking handler without recovery should be measured as an internal error and panic.",
+			config: prommiddleware.Config{},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				panic("test")
+			},
+			expPanic: true,
+			expMetrics: []string{
+				`http_request_duration_seconds_count{code="500",handler="test",method="GET"} 1`,
+				`http_request_panics_total{handler="test"} 1`,
+				`http_requests_inflight{handler="test"} 0`,
+			},
+		},
+		{
+			name:   "A panicking handler with recovery should be measured as an internal error and respond with an internal error.",
+			config: prommiddleware.Config{RecoverPanics: true},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				panic("test")
+			},
+			expPanic:    false,
+			expRespCode: 500,
+			expRespBody: "Internal Server Error\n",
+			expMetrics: []string{
+				`http_request_duration_seconds_count{code="500",handler="test",method="GET"} 1`,
+				`http_response_size_bytes_sum{code="500",handler="test",method="GET"} 22`,
+				`http_request_panics_total{handler="test"} 1`,
+			},
+		},
+		{
+			name:   "A panicking handler with recovery that already wrote the headers should be measured as an internal error and not modify the response.",
+			config: prommiddleware.Config{RecoverPanics: true},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+				w.Write([]byte("test"))
+				panic("test")
+			},
+			expPanic:    false,
+			expRespCode: 202,
+			expRespBody: "test",
+			expMetrics: []string{
+				`http_request_duration_seconds_count{code="500",handler="test",method="GET"} 1`,
+				`http_request_panics_total{handler="test"} 1`,
+			},
+		},
+		{
+			name:   "A handler aborting with recovery should be measured as aborted by the client and panic.",
+			config: prommiddleware.Config{RecoverPanics: true},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				panic(http.ErrAbortHandler)
+			},
+			expPanic: true,
+			expMetrics: []string{
+				`http_request_duration_seconds_count{code="499",handler="test",method="GET"} 1`,
+				`http_requests_client_aborted_total{handler="test"} 1`,
+			},
+			expNotMetrics: []string{
+				`code="500"`,
+				`http_request_panics_total{handler="test"}`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			reg := prometheus.NewRegistry()
+			m := prommiddleware.New(test.config, reg)
+			h := m.Handler("test", test.handler)
+
+			rec := httptest.NewRecorder()
+			serve := func() { h.ServeHTTP(rec, httptest.NewRequest("GET", "/test", nil)) }
+			if test.expPanic {
+				assert.Panics(serve)
+			} else {
+				assert.NotPanics(serve)
+				assert.Equal(test.expRespCode, rec.Code)
+				assert.Equal(test.expRespBody, rec.Body.String())
+			}
+
+			metrics := getMetrics(reg)
+			for _, expMetric := range test.expMetrics {
+				assert.Contains(metrics, expMetric)
+			}
+			for _, expNotMetric := range test.expNotMetrics {
+				assert.NotContains(metrics, expNotMetric)
+			}
+		})
+	}
+}
+
+func TestMiddlewareClientAborted(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     prommiddleware.Config
+		request    func() (req *http.Request, abort func())
+		expMetrics []string
+	}{
+		{
+			name:   "A request canceled by the client should be measured with the default client aborted code.",
+			config: prommiddleware.Config{},
+			request: func() (*http.Request, func()) {
+				ctx, cancel := context.WithCancel(context.Background())
+				return httptest.NewRequest("GET", "/test", nil).WithContext(ctx), cancel
+			},
+			expMetrics: []string{
+				`http_request_duration_seconds_count{code="499",handler="test",method="GET"} 1`,
+				`http_requests_client_aborted_total{handler="test"} 1`,
+			},
+		},
+		{
+			name:   "A request canceled by the client should be measured with the custom client aborted code.",
+			config: prommiddleware.Config{ClientAbortedCode: 444},
+			request: func() (*http.Request, func()) {
+				ctx, cancel := context.WithCancel(context.Background())
+				return httptest.NewRequest("GET", "/test", nil).WithContext(ctx), cancel
+			},
+			expMetrics: []string{
+				`http_request_duration_seconds_count{code="444",handler="test",method="GET"} 1`,
+				`http_requests_client_aborted_total{handler="test"} 1`,
+			},
+		},
+		{
+			name:   "A request that timed out shouldn't be measured as aborted by the client.",
+			config: prommiddleware.Config{},
+			request: func() (*http.Request, func()) {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+				// Wait for the deadline before cleaning up so the client doesn't abort the request.
+				abort := func() {
+					<-ctx.Done()
+					cancel()
+				}
+				return httptest.NewRequest("GET", "/test", nil).WithContext(ctx), abort
+			},
+			expMetrics: []string{
+				`http_request_duration_seconds_count{code="504",handler="test",method="GET"} 1`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			reg := prometheus.NewRegistry()
+			m := prommiddleware.New(test.config, reg)
+
+			r, abort := test.request()
+			h := m.Handler("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Abort the request while the handler is processing it.
+				abort()
+				<-r.Context().Done()
+				if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+					w.WriteHeader(http.StatusGatewayTimeout)
+				}
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			metrics := getMetrics(reg)
+			for _, expMetric := range test.expMetrics {
+				assert.Contains(metrics, expMetric)
+			}
+		})
+	}
+}
+
+func TestMiddlewareClientAbortedServer(t *testing.T) {
+	assert := assert.New(t)
+
+	reg := prometheus.NewRegistry()
+	m := prommiddleware.New(prommiddleware.Config{}, reg)
+
+	started := make(chan struct{})
+	finished := make(chan struct{})
+	h := m.Handler("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(finished)
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	// Make a request and disconnect before the handler finishes.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	_, err := http.DefaultClient.Do(req.WithContext(ctx))
+	assert.Error(err)
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler didn't finish")
+	}
+
+	assert.Contains(getMetrics(reg), `http_request_duration_seconds_count{code="499",handler="test",method="GET"} 1`)
+}
+
 func BenchmarkMiddlewareHandler(b *testing.B) {
 	b.StopTimer()
 
@@ -200,7 +1542,7 @@ func BenchmarkMiddlewareHandler(b *testing.B) {
 			// Prepare.
 			reg := prometheus.NewRegistry()
 			m := prommiddleware.New(bench.cfg, reg)
-			h := m.Handler(bench.handlerID, getFakeHandler(200))
+			h := m.Handler(bench.handlerID, getFakeHandler(200, ""))
 			r := httptest.NewRequest("GET", "/test", nil)
 
 			// Make the requests.
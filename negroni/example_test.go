@@ -3,11 +3,12 @@ package negroni_test
 import (
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	prommiddleware "github.com/slok/go-prometheus-middleware"
 	promnegroni "github.com/slok/go-prometheus-middleware/negroni"
-	"github.com/urfave/negroni"
+	"github.com/urfave/negroni/v3"
 )
 
 // NegroniMiddleware shows how you would create a default middleware factory and use it
@@ -40,3 +41,33 @@ func Example_negroniMiddleware() {
 		log.Panicf("error while serving: %s", err)
 	}
 }
+
+// HandlerWithResolver shows how you would measure the requests grouped by the first
+// segment of the URL path, because negroni doesn't have routes to get the handler IDs from.
+func Example_handlerWithResolver() {
+	// Create our middleware factory with the default settings.
+	mdlw := prommiddleware.NewDefault()
+
+	// Create our negroni instance.
+	n := negroni.Classic()
+
+	// Add the middleware to negroni, `/users/42` and `/users/43` will be measured as `users`.
+	n.Use(promnegroni.HandlerWithResolver(func(r *http.Request) string {
+		return strings.SplitN(r.URL.Path, "/", 3)[1]
+	}, mdlw))
+
+	// Finally set our handler on negroni.
+	n.UseHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello world!"))
+	}))
+
+	// Serve metrics from the default prometheus registry.
+	log.Printf("serving metrics at: %s", ":8081")
+	go http.ListenAndServe(":8081", promhttp.Handler())
+
+	// Serve our handler.
+	log.Printf("listening at: %s", ":8080")
+	if err := http.ListenAndServe(":8080", n); err != nil {
+		log.Panicf("error while serving: %s", err)
+	}
+}
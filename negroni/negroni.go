@@ -5,16 +5,81 @@ package negroni
 
 import (
 	"net/http"
+	"time"
 
-	"github.com/urfave/negroni"
+	"github.com/urfave/negroni/v3"
 
 	prommiddleware "github.com/slok/go-prometheus-middleware"
 )
 
+// HandlerIDResolver returns the handler ID of a request. Negroni doesn't have routing,
+// so the resolver can be used to group the requests by something other than the URL
+// path (e.g the first path segment). If it returns an empty handler ID the middleware
+// will use the URL path as the handler ID.
+type HandlerIDResolver func(r *http.Request) string
+
 // Handler returns a Negroni compatible middleware from a Middleware factory instance.
 // The first handlerID argument is the same argument passed on Middleware.Handler method.
 func Handler(handlerID string, m prommiddleware.Middleware) negroni.Handler {
+	return HandlerWithResolver(func(_ *http.Request) string { return handlerID }, m)
+}
+
+// HandlerWithResolver returns a Negroni compatible middleware from a Middleware factory
+// instance that gets the handler ID of each request from the resolver.
+func HandlerWithResolver(resolve HandlerIDResolver, m prommiddleware.Middleware) negroni.Handler {
 	return negroni.HandlerFunc(func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-		m.Handler(handlerID, next).ServeHTTP(rw, r)
+		// Negroni already wraps the writer, if we have its writer the next handlers
+		// will write on it directly instead of on the writer of the middleware, this way
+		// we don't hide the optional interfaces of the writer (e.g http.Hijacker) and the
+		// middleware gets the response data from the negroni writer.
+		nrw, ok := rw.(negroni.ResponseWriter)
+		if !ok {
+			m.Handler(resolve(r), next).ServeHTTP(rw, r)
+			return
+		}
+
+		// Create a dummy handler to wrap the next handlers of negroni, this way Middleware
+		// interface can wrap the negroni chain.
+		dh := http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			next(nrw, r)
+		})
+
+		// Negroni calls the before hooks when the headers are going to be written, that's
+		// when the first byte of the response is sent.
+		rr := &responseReporter{ResponseWriter: nrw}
+		nrw.Before(func(negroni.ResponseWriter) {
+			if rr.firstByteAt.IsZero() {
+				rr.firstByteAt = time.Now()
+			}
+		})
+
+		m.Handler(resolve(r), dh).ServeHTTP(rr, r)
 	})
 }
+
+// responseReporter reports the response data of the negroni writer to the middleware.
+type responseReporter struct {
+	negroni.ResponseWriter
+	firstByteAt time.Time
+}
+
+func (r *responseReporter) StatusCode() int {
+	// Negroni doesn't have a status until the headers are written, if the handler
+	// doesn't write them, they are sent implicitly with a 200.
+	if !r.Written() {
+		return http.StatusOK
+	}
+	return r.Status()
+}
+
+func (r *responseReporter) BytesWritten() int64 {
+	return int64(r.Size())
+}
+
+func (r *responseReporter) WroteHeader() bool {
+	return r.Written()
+}
+
+func (r *responseReporter) FirstByteAt() time.Time {
+	return r.firstByteAt
+}
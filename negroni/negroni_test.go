@@ -0,0 +1,187 @@
+package negroni_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/negroni/v3"
+
+	prommiddleware "github.com/slok/go-prometheus-middleware"
+	promnegroni "github.com/slok/go-prometheus-middleware/negroni"
+)
+
+func getMetrics(reg prometheus.Gatherer) string {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(rec, req)
+	body, _ := ioutil.ReadAll(rec.Result().Body)
+	return string(body)
+}
+
+func TestHandlerStatusCode(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		expCode string
+		expSize int
+	}{
+		{
+			name:    "A handler that doesn't write should be measured with the implicit status code.",
+			handler: func(w http.ResponseWriter, r *http.Request) {},
+			expCode: "200",
+			expSize: 0,
+		},
+		{
+			name: "A handler that writes without status code should be measured with the implicit status code.",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("test"))
+			},
+			expCode: "200",
+			expSize: 4,
+		},
+		{
+			name: "A handler that writes a status code should be measured with the status code.",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte("not found"))
+			},
+			expCode: "404",
+			expSize: 9,
+		},
+		{
+			name: "A handler that writes the status code multiple times should be measured with the first one.",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusCreated)
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			expCode: "201",
+			expSize: 0,
+		},
+		{
+			name: "A handler that writes informational status codes should be measured with the final status code.",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusEarlyHints)
+				w.WriteHeader(http.StatusAccepted)
+			},
+			expCode: "202",
+			expSize: 0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			mdlw := prommiddleware.New(prommiddleware.Config{}, reg)
+
+			n := negroni.New()
+			n.Use(promnegroni.Handler("test", mdlw))
+			n.UseHandler(test.handler)
+			n.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+
+			metrics := getMetrics(reg)
+			expMetric := fmt.Sprintf(`http_request_duration_seconds_count{code=%q,handler="test",method="GET"} 1`, test.expCode)
+			assert.Contains(t, metrics, expMetric)
+			expSizeMetric := fmt.Sprintf(`http_response_size_bytes_sum{code=%q,handler="test",method="GET"} %d`, test.expCode, test.expSize)
+			assert.Contains(t, metrics, expSizeMetric)
+		})
+	}
+}
+
+func TestHandlerResponseWriter(t *testing.T) {
+	t.Run("The next handlers should receive the negroni writer with its optional interfaces.", func(t *testing.T) {
+		assert := assert.New(t)
+
+		var isNegroniWriter, isFlusher, isHijacker bool
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, isNegroniWriter = w.(negroni.ResponseWriter)
+			_, isFlusher = w.(http.Flusher)
+			_, isHijacker = w.(http.Hijacker)
+			w.WriteHeader(http.StatusAccepted)
+		})
+
+		reg := prometheus.NewRegistry()
+		mdlw := prommiddleware.New(prommiddleware.Config{}, reg)
+
+		n := negroni.New()
+		n.Use(promnegroni.Handler("test", mdlw))
+		n.UseHandler(h)
+
+		// Use a real server so the writer is a hijacker.
+		srv := httptest.NewServer(n)
+		defer srv.Close()
+		resp, err := http.Get(srv.URL)
+		if assert.NoError(err) {
+			resp.Body.Close()
+		}
+
+		assert.True(isNegroniWriter)
+		assert.True(isFlusher)
+		assert.True(isHijacker)
+		assert.Contains(getMetrics(reg), `http_request_duration_seconds_count{code="202",handler="test",method="GET"} 1`)
+	})
+}
+
+func TestHandlerTimeToFirstByte(t *testing.T) {
+	t.Run("A streaming handler should measure the time to first byte until the headers are sent.", func(t *testing.T) {
+		assert := assert.New(t)
+
+		reg := prometheus.NewRegistry()
+		mdlw := prommiddleware.New(prommiddleware.Config{}, reg)
+
+		n := negroni.New()
+		n.Use(promnegroni.Handler("test", mdlw))
+		n.UseHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("test"))
+			time.Sleep(150 * time.Millisecond)
+		}))
+		n.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+
+		metrics := getMetrics(reg)
+		assert.Contains(metrics, `http_request_ttfb_seconds_bucket{code="200",handler="test",method="GET",le="0.1"} 1`)
+		assert.Contains(metrics, `http_request_duration_seconds_bucket{code="200",handler="test",method="GET",le="0.1"} 0`)
+	})
+}
+
+func TestHandlerWithResolver(t *testing.T) {
+	tests := []struct {
+		name      string
+		resolver  promnegroni.HandlerIDResolver
+		path      string
+		expMetric string
+	}{
+		{
+			name:      "The handler ID returned by the resolver should be used as the handler ID.",
+			resolver:  func(r *http.Request) string { return strings.SplitN(r.URL.Path, "/", 3)[1] },
+			path:      "/users/42",
+			expMetric: `http_request_duration_seconds_count{code="200",handler="users",method="GET"} 1`,
+		},
+		{
+			name:      "An empty handler ID returned by the resolver should use the URL path as the handler ID.",
+			resolver:  func(r *http.Request) string { return "" },
+			path:      "/users/42",
+			expMetric: `http_request_duration_seconds_count{code="200",handler="/users/42",method="GET"} 1`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			mdlw := prommiddleware.New(prommiddleware.Config{}, reg)
+
+			n := negroni.New()
+			n.Use(promnegroni.HandlerWithResolver(test.resolver, mdlw))
+			n.UseHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			n.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", test.path, nil))
+
+			assert.Contains(t, getMetrics(reg), test.expMetric)
+		})
+	}
+}
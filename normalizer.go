@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"regexp"
+	"strings"
+)
+
+// PathNormalizer knows how to normalize the URL paths used as the handler ID when
+// the middleware infers the handler ID from the request URL, e.g `/users/123` to
+// `/users/:id`. This reduces the cardinality of the handler label.
+type PathNormalizer interface {
+	// Normalize returns the normalized path.
+	Normalize(path string) string
+}
+
+// PathNormalizerFunc is a helper to create a PathNormalizer from a function.
+type PathNormalizerFunc func(path string) string
+
+// Normalize satisfies PathNormalizer interface.
+func (f PathNormalizerFunc) Normalize(path string) string { return f(path) }
+
+// PathRule is a rewrite rule for the URL paths.
+type PathRule struct {
+	// Regexp is the regular expression that will be replaced on the path.
+	Regexp *regexp.Regexp
+	// Replacement is the replacement for the matches of Regexp, it supports
+	// the same expansions as regexp.Regexp.ReplaceAllString (e.g `$1`).
+	Replacement string
+}
+
+// defaultSegmentRules are the built-in rules that are applied to each segment of
+// the path, only the first matching rule is applied to a segment.
+var defaultSegmentRules = []PathRule{
+	{Regexp: regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`), Replacement: ":uuid"},
+	{Regexp: regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`), Replacement: ":date"},
+	{Regexp: regexp.MustCompile(`^\d+$`), Replacement: ":id"},
+	{Regexp: regexp.MustCompile(`^[0-9a-fA-F]{16,}$`), Replacement: ":hash"},
+}
+
+// DefaultPathNormalizer is the path normalizer with only the built-in rules.
+var DefaultPathNormalizer = NewPathNormalizer()
+
+type pathNormalizer struct {
+	rules []PathRule
+}
+
+// NewPathNormalizer returns a PathNormalizer that will apply the received rules in
+// order to the whole path and then the built-in rules to each path segment. The
+// built-in rules replace the segments that are numbers (`:id`), UUIDs (`:uuid`),
+// dates in `YYYY-MM-DD` format (`:date`) or hexadecimal hashes (`:hash`).
+func NewPathNormalizer(rules ...PathRule) PathNormalizer {
+	return &pathNormalizer{rules: rules}
+}
+
+func (p *pathNormalizer) Normalize(path string) string {
+	for _, rule := range p.rules {
+		path = rule.Regexp.ReplaceAllString(path, rule.Replacement)
+	}
+
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if segment == "" {
+			continue
+		}
+
+		for _, rule := range defaultSegmentRules {
+			if rule.Regexp.MatchString(segment) {
+				segments[i] = rule.Regexp.ReplaceAllString(segment, rule.Replacement)
+				break
+			}
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
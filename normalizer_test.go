@@ -0,0 +1,80 @@
+package middleware_test
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	prommiddleware "github.com/slok/go-prometheus-middleware"
+)
+
+func TestPathNormalizer(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []prommiddleware.PathRule
+		path    string
+		expPath string
+	}{
+		{
+			name:    "A path without dynamic segments shouldn't be changed.",
+			path:    "/api/v1/users",
+			expPath: "/api/v1/users",
+		},
+		{
+			name:    "Numeric segments should be replaced.",
+			path:    "/users/12345/posts/6",
+			expPath: "/users/:id/posts/:id",
+		},
+		{
+			name:    "UUID segments should be replaced.",
+			path:    "/users/123e4567-e89b-12d3-a456-426614174000/",
+			expPath: "/users/:uuid/",
+		},
+		{
+			name:    "Hexadecimal hash segments should be replaced.",
+			path:    "/commits/da39a3ee5e6b4b0d3255bfef95601890afd80709",
+			expPath: "/commits/:hash",
+		},
+		{
+			name:    "Short hexadecimal segments shouldn't be replaced.",
+			path:    "/colors/deadbeef",
+			expPath: "/colors/deadbeef",
+		},
+		{
+			name:    "Date segments should be replaced.",
+			path:    "/reports/2018-10-11/summary",
+			expPath: "/reports/:date/summary",
+		},
+		{
+			name:    "Segments partially dynamic shouldn't be replaced.",
+			path:    "/users/user123/v2",
+			expPath: "/users/user123/v2",
+		},
+		{
+			name: "Custom rules should be applied in order before the built-in rules.",
+			rules: []prommiddleware.PathRule{
+				{Regexp: regexp.MustCompile(`^/profiles/[^/]+`), Replacement: "/profiles/:name"},
+				{Regexp: regexp.MustCompile(`/:name/avatar\.(png|jpg)$`), Replacement: "/:name/avatar.$1"},
+				{Regexp: regexp.MustCompile(`\.(png|jpg)$`), Replacement: ".:ext"},
+			},
+			path:    "/profiles/batman/avatar.png/123",
+			expPath: "/profiles/:name/avatar.png/:id",
+		},
+		{
+			name: "Custom rules should be applied to the whole path.",
+			rules: []prommiddleware.PathRule{
+				{Regexp: regexp.MustCompile(`^/static/.*`), Replacement: "/static/*"},
+			},
+			path:    "/static/css/12/main.css",
+			expPath: "/static/*",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := prommiddleware.NewPathNormalizer(test.rules...)
+			assert.Equal(t, test.expPath, n.Normalize(test.path))
+		})
+	}
+}
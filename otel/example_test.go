@@ -0,0 +1,41 @@
+package otel_test
+
+import (
+	"log"
+	"net/http"
+
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+
+	prommiddleware "github.com/slok/go-prometheus-middleware"
+	promotel "github.com/slok/go-prometheus-middleware/otel"
+)
+
+// OTelMiddleware shows how you would create a middleware factory that measures
+// using OpenTelemetry metrics instead of Prometheus.
+func Example_oTelMiddleware() {
+	// Create our OpenTelemetry meter provider, this is where you would set
+	// your readers and exporters (e.g OTLP exporter).
+	provider := sdkmetric.NewMeterProvider()
+
+	// Create our OpenTelemetry recorder and the middleware factory using it.
+	rec, err := promotel.NewRecorder(promotel.Config{MeterProvider: provider})
+	if err != nil {
+		log.Panicf("error creating recorder: %s", err)
+	}
+	mdlw := prommiddleware.NewWithRecorder(prommiddleware.Config{}, rec)
+
+	// Create our handler.
+	myHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello world!"))
+	})
+
+	// Wrap our handler with the middleware.
+	h := mdlw.Handler("", myHandler)
+
+	// Serve our handler.
+	log.Printf("listening at: %s", ":8080")
+	if err := http.ListenAndServe(":8080", h); err != nil {
+		log.Panicf("error while serving: %s", err)
+	}
+}
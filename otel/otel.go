@@ -0,0 +1,216 @@
+// Package otel is a helper package to measure the HTTP metrics of the
+// Middleware factory (from github.com/slok/go-prometheus-middleware) using
+// OpenTelemetry metrics instead of Prometheus.
+// The metrics follow the OpenTelemetry HTTP semantic conventions.
+package otel
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	prommiddleware "github.com/slok/go-prometheus-middleware"
+)
+
+const instrumentationName = "github.com/slok/go-prometheus-middleware/otel"
+
+// Config is the configuration for the OpenTelemetry recorder.
+type Config struct {
+	// MeterProvider is the provider used to create the OpenTelemetry instruments, by
+	// default it will use the global meter provider.
+	MeterProvider metric.MeterProvider
+	// DurationBuckets are the explicit bucket boundaries (in seconds) used for the
+	// HTTP request duration metrics, by default uses the semantic conventions
+	// recommended buckets (from 5ms to 10s).
+	DurationBuckets []float64
+	// SizeBuckets are the explicit bucket boundaries (in bytes) used for the HTTP request
+	// and response size metrics, by default uses exponential buckets from 100B to 1GB.
+	SizeBuckets []float64
+}
+
+func (c *Config) validate() {
+	if c.MeterProvider == nil {
+		c.MeterProvider = otel.GetMeterProvider()
+	}
+
+	if len(c.DurationBuckets) == 0 {
+		c.DurationBuckets = []float64{.005, .01, .025, .05, .075, .1, .25, .5, .75, 1, 2.5, 5, 7.5, 10}
+	}
+
+	if len(c.SizeBuckets) == 0 {
+		c.SizeBuckets = []float64{100, 1000, 10000, 100000, 1000000, 10000000, 100000000, 1000000000}
+	}
+}
+
+// recorder is the OpenTelemetry implementation of the middleware Recorder.
+type recorder struct {
+	httpRequests         metric.Int64Counter
+	httpRequestDuration  metric.Float64Histogram
+	httpRequestTTFB      metric.Float64Histogram
+	httpRequestSize      metric.Int64Histogram
+	httpResponseSize     metric.Int64Histogram
+	httpRequestsInflight metric.Int64UpDownCounter
+	httpRequestPanics    metric.Int64Counter
+	httpClientAborted    metric.Int64Counter
+	httpRouteOverflow    metric.Int64Counter
+}
+
+// NewRecorder returns a middleware Recorder that measures the HTTP metrics using
+// OpenTelemetry instruments, use it with the middleware NewWithRecorder factory.
+func NewRecorder(cfg Config) (prommiddleware.Recorder, error) {
+	cfg.validate()
+
+	meter := cfg.MeterProvider.Meter(instrumentationName)
+
+	var err error
+	r := &recorder{}
+
+	r.httpRequests, err = meter.Int64Counter("http.server.requests",
+		metric.WithDescription("Number of HTTP server requests."),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	r.httpRequestDuration, err = meter.Float64Histogram("http.server.request.duration",
+		metric.WithDescription("Duration of HTTP server requests."),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(cfg.DurationBuckets...),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	r.httpRequestTTFB, err = meter.Float64Histogram("http.server.request.time_to_first_byte",
+		metric.WithDescription("Duration of HTTP server requests until the first byte of the response is written."),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(cfg.DurationBuckets...),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	r.httpRequestSize, err = meter.Int64Histogram("http.server.request.body.size",
+		metric.WithDescription("Size of HTTP server request bodies."),
+		metric.WithUnit("By"),
+		metric.WithExplicitBucketBoundaries(cfg.SizeBuckets...),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	r.httpResponseSize, err = meter.Int64Histogram("http.server.response.body.size",
+		metric.WithDescription("Size of HTTP server response bodies."),
+		metric.WithUnit("By"),
+		metric.WithExplicitBucketBoundaries(cfg.SizeBuckets...),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	r.httpRequestsInflight, err = meter.Int64UpDownCounter("http.server.active_requests",
+		metric.WithDescription("Number of active HTTP server requests."),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	r.httpRequestPanics, err = meter.Int64Counter("http.server.request.panics",
+		metric.WithDescription("Number of HTTP server requests where the handler panicked."),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	r.httpClientAborted, err = meter.Int64Counter("http.server.request.client_aborted",
+		metric.WithDescription("Number of HTTP server requests where the client disconnected before the handler finished."),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	r.httpRouteOverflow, err = meter.Int64Counter("http.server.route.overflow",
+		metric.WithDescription("Number of HTTP server requests measured with the overflow route due to the route limit."),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *recorder) IncRequests(ctx context.Context, p prommiddleware.HTTPReqProperties) {
+	r.httpRequests.Add(ctx, 1, metric.WithAttributeSet(reqAttributes(p)))
+}
+
+func (r *recorder) ObserveHTTPRequestDuration(ctx context.Context, p prommiddleware.HTTPReqProperties, duration time.Duration) {
+	r.httpRequestDuration.Record(ctx, duration.Seconds(), metric.WithAttributeSet(reqAttributes(p)))
+}
+
+func (r *recorder) ObserveHTTPRequestTimeToFirstByte(ctx context.Context, p prommiddleware.HTTPReqProperties, duration time.Duration) {
+	r.httpRequestTTFB.Record(ctx, duration.Seconds(), metric.WithAttributeSet(reqAttributes(p)))
+}
+
+func (r *recorder) ObserveHTTPRequestSize(ctx context.Context, p prommiddleware.HTTPReqProperties, sizeBytes int64) {
+	r.httpRequestSize.Record(ctx, sizeBytes, metric.WithAttributeSet(reqAttributes(p)))
+}
+
+func (r *recorder) ObserveHTTPResponseSize(ctx context.Context, p prommiddleware.HTTPReqProperties, sizeBytes int64) {
+	r.httpResponseSize.Record(ctx, sizeBytes, metric.WithAttributeSet(reqAttributes(p)))
+}
+
+func (r *recorder) AddInflightRequests(ctx context.Context, p prommiddleware.HTTPProperties, quantity int) {
+	r.httpRequestsInflight.Add(ctx, int64(quantity), metric.WithAttributes(attribute.String("http.route", p.ID)))
+}
+
+func (r *recorder) IncPanics(ctx context.Context, p prommiddleware.HTTPProperties) {
+	r.httpRequestPanics.Add(ctx, 1, metric.WithAttributes(attribute.String("http.route", p.ID)))
+}
+
+func (r *recorder) IncClientAbortedRequests(ctx context.Context, p prommiddleware.HTTPProperties) {
+	r.httpClientAborted.Add(ctx, 1, metric.WithAttributes(attribute.String("http.route", p.ID)))
+}
+
+func (r *recorder) IncHandlerLabelOverflow(ctx context.Context) {
+	r.httpRouteOverflow.Add(ctx, 1)
+}
+
+// otherMethod is the semantic convention value of the unknown HTTP methods.
+const otherMethod = "_OTHER"
+
+// reqAttributes returns the semantic convention attributes of a request and the extra
+// labels. The status code is an integer attribute, if the middleware groups the status
+// codes (e.g `2xx`) they are set on the `http.response.status_code_group` attribute
+// instead, because the semantic conventions don't have grouped status codes.
+func reqAttributes(p prommiddleware.HTTPReqProperties) attribute.Set {
+	code := attribute.String("http.response.status_code_group", p.Code)
+	if c, err := strconv.Atoi(p.Code); err == nil {
+		code = attribute.Int("http.response.status_code", c)
+	}
+
+	// The middleware measures the unknown methods as `other`.
+	method := p.Method
+	if method == "other" {
+		method = otherMethod
+	}
+
+	attrs := []attribute.KeyValue{
+		attribute.String("http.route", p.ID),
+		attribute.String("http.request.method", method),
+		code,
+	}
+	for _, l := range p.ExtraLabels {
+		attrs = append(attrs, attribute.String(l.Name, l.Value))
+	}
+
+	return attribute.NewSet(attrs...)
+}
@@ -0,0 +1,136 @@
+package otel_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	prommiddleware "github.com/slok/go-prometheus-middleware"
+	promotel "github.com/slok/go-prometheus-middleware/otel"
+)
+
+func getMetrics(t *testing.T, reader sdkmetric.Reader) map[string]metricdata.Metrics {
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+
+	metrics := map[string]metricdata.Metrics{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			metrics[m.Name] = m
+		}
+	}
+	return metrics
+}
+
+func TestRecorder(t *testing.T) {
+	tests := []struct {
+		name                 string
+		config               prommiddleware.Config
+		method               string
+		statusCode           int
+		expMethod            string
+		expStatusCode        attribute.KeyValue
+		expCounterStatusCode attribute.KeyValue
+	}{
+		{
+			name:                 "Measuring with the OpenTelemetry recorder should use the semantic convention attributes.",
+			config:               prommiddleware.Config{},
+			method:               "POST",
+			statusCode:           http.StatusCreated,
+			expMethod:            "POST",
+			expStatusCode:        attribute.Int("http.response.status_code", 201),
+			expCounterStatusCode: attribute.Int("http.response.status_code", 201),
+		},
+		{
+			name:                 "Measuring with the OpenTelemetry recorder and grouped status codes should use the grouped status code attribute.",
+			config:               prommiddleware.Config{GroupedStatus: true},
+			method:               "POST",
+			statusCode:           http.StatusCreated,
+			expMethod:            "POST",
+			expStatusCode:        attribute.String("http.response.status_code_group", "2xx"),
+			expCounterStatusCode: attribute.Int("http.response.status_code", 201),
+		},
+		{
+			name:                 "Measuring with the OpenTelemetry recorder an unknown method should use the semantic convention other method.",
+			config:               prommiddleware.Config{},
+			method:               "FOOBAR",
+			statusCode:           http.StatusCreated,
+			expMethod:            "_OTHER",
+			expStatusCode:        attribute.Int("http.response.status_code", 201),
+			expCounterStatusCode: attribute.Int("http.response.status_code", 201),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			reader := sdkmetric.NewManualReader()
+			rec, err := promotel.NewRecorder(promotel.Config{
+				MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+			})
+			require.NoError(err)
+
+			m := prommiddleware.NewWithRecorder(test.config, rec)
+			h := m.Handler("/users/:id", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.ReadAll(r.Body)
+				w.WriteHeader(test.statusCode)
+				w.Write([]byte("hello world!"))
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(test.method, "/users/42", strings.NewReader("test")))
+
+			metrics := getMetrics(t, reader)
+			expAttrs := attribute.NewSet(
+				attribute.String("http.route", "/users/:id"),
+				attribute.String("http.request.method", test.expMethod),
+				test.expStatusCode,
+			)
+
+			// Requests.
+			requestsData := metrics["http.server.requests"].Data.(metricdata.Sum[int64])
+			require.Len(requestsData.DataPoints, 1)
+			assert.Equal(attribute.NewSet(
+				attribute.String("http.route", "/users/:id"),
+				attribute.String("http.request.method", test.expMethod),
+				test.expCounterStatusCode,
+			), requestsData.DataPoints[0].Attributes)
+			assert.Equal(int64(1), requestsData.DataPoints[0].Value)
+
+			// Duration.
+			duration := metrics["http.server.request.duration"]
+			assert.Equal("s", duration.Unit)
+			durationData := duration.Data.(metricdata.Histogram[float64])
+			require.Len(durationData.DataPoints, 1)
+			assert.Equal(expAttrs, durationData.DataPoints[0].Attributes)
+			assert.Equal(uint64(1), durationData.DataPoints[0].Count)
+
+			// Request size.
+			reqSizeData := metrics["http.server.request.body.size"].Data.(metricdata.Histogram[int64])
+			require.Len(reqSizeData.DataPoints, 1)
+			assert.Equal(expAttrs, reqSizeData.DataPoints[0].Attributes)
+			assert.Equal(int64(4), reqSizeData.DataPoints[0].Sum)
+
+			// Response size.
+			respSizeData := metrics["http.server.response.body.size"].Data.(metricdata.Histogram[int64])
+			require.Len(respSizeData.DataPoints, 1)
+			assert.Equal(expAttrs, respSizeData.DataPoints[0].Attributes)
+			assert.Equal(int64(12), respSizeData.DataPoints[0].Sum)
+
+			// Inflight requests.
+			inflightData := metrics["http.server.active_requests"].Data.(metricdata.Sum[int64])
+			require.Len(inflightData.DataPoints, 1)
+			assert.Equal(attribute.NewSet(attribute.String("http.route", "/users/:id")), inflightData.DataPoints[0].Attributes)
+			assert.Equal(int64(0), inflightData.DataPoints[0].Value)
+		})
+	}
+}
@@ -0,0 +1,314 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// prometheusRecorder is the Prometheus implementation of the Recorder.
+type prometheusRecorder struct {
+	httpRequestsTotal         *prometheus.CounterVec
+	httpRequestHistogram      *prometheus.HistogramVec
+	httpRequestSummary        *prometheus.SummaryVec
+	httpRequestTTFBHistogram  *prometheus.HistogramVec
+	httpRequestSizeHistogram  *prometheus.HistogramVec
+	httpResponseSizeHistogram *prometheus.HistogramVec
+	httpRequestsInflight      *prometheus.GaugeVec
+	httpRequestPanics         *prometheus.CounterVec
+	httpRequestsClientAborted *prometheus.CounterVec
+	httpHandlerLabelOverflow  prometheus.Counter
+}
+
+// newPrometheusRecorder returns a Recorder that measures the HTTP metrics using
+// Prometheus metrics registered on the received registerer.
+func newPrometheusRecorder(cfg Config, reg prometheus.Registerer) (*prometheusRecorder, error) {
+	reqLabels := []string{"handler", "method", "code"}
+	for _, l := range cfg.ExtraLabels {
+		reqLabels = append(reqLabels, l.Name)
+	}
+
+	rg := &registration{reg: reg}
+	r := &prometheusRecorder{}
+	if err := r.registerMetrics(cfg, rg, reqLabels); err != nil {
+		// Don't leave the metrics registered until the failure on the registerer.
+		rg.unregister()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// registerMetrics creates all the middleware metrics and registers them on the
+// Prometheus registerer.
+func (r *prometheusRecorder) registerMetrics(cfg Config, rg *registration, reqLabels []string) error {
+	var err error
+
+	requestsOpts := prometheus.CounterOpts{
+		Namespace: cfg.Prefix,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "The number of HTTP requests.",
+	}
+	if r.httpRequestsTotal, err = registerOrReuse(rg, prometheus.NewCounterVec(requestsOpts, reqLabels), requestsOpts); err != nil {
+		return err
+	}
+
+	// Measure the latency with a histogram, a summary or both. If we only use the summary
+	// it takes the name of the histogram so it can be queried the same way.
+	if !cfg.SummaryOnly {
+		durationOpts := latencyHistogramOpts(cfg, prometheus.HistogramOpts{
+			Namespace: cfg.Prefix,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "The latency of the HTTP requests.",
+		})
+		if r.httpRequestHistogram, err = registerOrReuse(rg, prometheus.NewHistogramVec(durationOpts, reqLabels), durationOpts); err != nil {
+			return err
+		}
+	}
+
+	if len(cfg.SummaryObjectives) > 0 {
+		name := "request_summary_duration_seconds"
+		if cfg.SummaryOnly {
+			name = "request_duration_seconds"
+		}
+		summaryOpts := prometheus.SummaryOpts{
+			Namespace:  cfg.Prefix,
+			Subsystem:  "http",
+			Name:       name,
+			Help:       "The latency of the HTTP requests.",
+			Objectives: cfg.SummaryObjectives,
+			MaxAge:     cfg.SummaryMaxAge,
+			AgeBuckets: cfg.SummaryAgeBuckets,
+		}
+		if r.httpRequestSummary, err = registerOrReuse(rg, prometheus.NewSummaryVec(summaryOpts, reqLabels), summaryOpts); err != nil {
+			return err
+		}
+	}
+
+	ttfbOpts := latencyHistogramOpts(cfg, prometheus.HistogramOpts{
+		Namespace: cfg.Prefix,
+		Subsystem: "http",
+		Name:      "request_ttfb_seconds",
+		Help:      "The latency of the HTTP requests until the first byte of the response is written.",
+	})
+	if r.httpRequestTTFBHistogram, err = registerOrReuse(rg, prometheus.NewHistogramVec(ttfbOpts, reqLabels), ttfbOpts); err != nil {
+		return err
+	}
+
+	reqSizeOpts := prometheus.HistogramOpts{
+		Namespace: cfg.Prefix,
+		Subsystem: "http",
+		Name:      "request_size_bytes",
+		Help:      "The size of the HTTP requests.",
+		Buckets:   cfg.SizeBuckets,
+	}
+	if r.httpRequestSizeHistogram, err = registerOrReuse(rg, prometheus.NewHistogramVec(reqSizeOpts, reqLabels), reqSizeOpts); err != nil {
+		return err
+	}
+
+	respSizeOpts := prometheus.HistogramOpts{
+		Namespace: cfg.Prefix,
+		Subsystem: "http",
+		Name:      "response_size_bytes",
+		Help:      "The size of the HTTP responses.",
+		Buckets:   cfg.SizeBuckets,
+	}
+	if r.httpResponseSizeHistogram, err = registerOrReuse(rg, prometheus.NewHistogramVec(respSizeOpts, reqLabels), respSizeOpts); err != nil {
+		return err
+	}
+
+	inflightOpts := prometheus.GaugeOpts{
+		Namespace: cfg.Prefix,
+		Subsystem: "http",
+		Name:      "requests_inflight",
+		Help:      "The number of inflight requests being handled at the same time.",
+	}
+	if r.httpRequestsInflight, err = registerOrReuse(rg, prometheus.NewGaugeVec(inflightOpts, []string{"handler"}), inflightOpts); err != nil {
+		return err
+	}
+
+	panicsOpts := prometheus.CounterOpts{
+		Namespace: cfg.Prefix,
+		Subsystem: "http",
+		Name:      "request_panics_total",
+		Help:      "The number of HTTP requests where the handler panicked.",
+	}
+	if r.httpRequestPanics, err = registerOrReuse(rg, prometheus.NewCounterVec(panicsOpts, []string{"handler"}), panicsOpts); err != nil {
+		return err
+	}
+
+	abortedOpts := prometheus.CounterOpts{
+		Namespace: cfg.Prefix,
+		Subsystem: "http",
+		Name:      "requests_client_aborted_total",
+		Help:      "The number of HTTP requests where the client disconnected before the handler finished.",
+	}
+	if r.httpRequestsClientAborted, err = registerOrReuse(rg, prometheus.NewCounterVec(abortedOpts, []string{"handler"}), abortedOpts); err != nil {
+		return err
+	}
+
+	overflowOpts := prometheus.CounterOpts{
+		Namespace: cfg.Prefix,
+		Subsystem: "http",
+		Name:      "handler_label_overflow_total",
+		Help:      "The number of requests measured with the overflow handler label due to the handler label limit.",
+	}
+	if r.httpHandlerLabelOverflow, err = registerOrReuse(rg, prometheus.NewCounter(overflowOpts), overflowOpts); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// latencyHistogramOpts sets the buckets of the latency histograms, these can be classic
+// buckets, native histogram buckets or both.
+func latencyHistogramOpts(cfg Config, opts prometheus.HistogramOpts) prometheus.HistogramOpts {
+	if cfg.NativeHistogramBucketFactor <= 1 {
+		opts.Buckets = cfg.Buckets
+		return opts
+	}
+
+	opts.NativeHistogramBucketFactor = cfg.NativeHistogramBucketFactor
+	opts.NativeHistogramMaxBucketNumber = cfg.NativeHistogramMaxBucketNumber
+	opts.NativeHistogramZeroThreshold = cfg.NativeHistogramZeroThreshold
+	if cfg.NativeHistogramWithClassicBuckets {
+		opts.Buckets = cfg.Buckets
+	}
+
+	return opts
+}
+
+// reqLabelValues returns the label values of the HTTP request metrics.
+func reqLabelValues(p HTTPReqProperties) []string {
+	values := make([]string, 0, 3+len(p.ExtraLabels))
+	values = append(values, p.ID, p.Method, p.Code)
+	for _, l := range p.ExtraLabels {
+		values = append(values, l.Value)
+	}
+	return values
+}
+
+// optsCollector is the collector registered by the middleware, it has the options used
+// to create the collector because the collector descriptors don't have all the options
+// (e.g the buckets), and we need them to know if a registered collector can be reused.
+type optsCollector[T prometheus.Collector] struct {
+	collector T
+	opts      any
+}
+
+func (o *optsCollector[T]) Describe(ch chan<- *prometheus.Desc) { o.collector.Describe(ch) }
+func (o *optsCollector[T]) Collect(ch chan<- prometheus.Metric) { o.collector.Collect(ch) }
+
+// registration tracks the collectors registered on the registerer so they can be
+// unregistered if the registration of the middleware metrics fails.
+type registration struct {
+	reg        prometheus.Registerer
+	registered []prometheus.Collector
+}
+
+// unregister unregisters all the collectors registered by the registration.
+func (rg *registration) unregister() {
+	for _, c := range rg.registered {
+		rg.reg.Unregister(c)
+	}
+	rg.registered = nil
+}
+
+// registerOrReuse registers the collector, if an equal collector of the same type created
+// with the same options is already registered (e.g by another middleware with the same
+// configuration) it returns the registered one so it can be reused instead of failing.
+func registerOrReuse[T prometheus.Collector](rg *registration, c T, opts any) (T, error) {
+	oc := &optsCollector[T]{collector: c, opts: opts}
+	err := rg.reg.Register(oc)
+	if err == nil {
+		rg.registered = append(rg.registered, oc)
+		return c, nil
+	}
+
+	var are prometheus.AlreadyRegisteredError
+	if !errors.As(err, &are) {
+		return c, fmt.Errorf("could not register metrics: %w", err)
+	}
+
+	existing, ok := are.ExistingCollector.(*optsCollector[T])
+	if !ok || !reflect.DeepEqual(existing.opts, opts) {
+		return c, fmt.Errorf("could not register metrics, an incompatible collector is already registered: %w", err)
+	}
+
+	return existing.collector, nil
+}
+
+func (r *prometheusRecorder) IncRequests(_ context.Context, p HTTPReqProperties) {
+	r.httpRequestsTotal.WithLabelValues(reqLabelValues(p)...).Inc()
+}
+
+func (r *prometheusRecorder) ObserveHTTPRequestDuration(_ context.Context, p HTTPReqProperties, duration time.Duration) {
+	lvs := reqLabelValues(p)
+
+	if r.httpRequestSummary != nil {
+		r.httpRequestSummary.WithLabelValues(lvs...).Observe(duration.Seconds())
+	}
+
+	if r.httpRequestHistogram == nil {
+		return
+	}
+
+	obs := r.httpRequestHistogram.WithLabelValues(lvs...)
+
+	// If we have a trace, measure with an exemplar so we can jump from the metrics to the trace.
+	if eo, ok := obs.(prometheus.ExemplarObserver); ok && validExemplarTraceID(p.TraceID) {
+		eo.ObserveWithExemplar(duration.Seconds(), prometheus.Labels{exemplarTraceIDLabel: p.TraceID})
+		return
+	}
+
+	obs.Observe(duration.Seconds())
+}
+
+func (r *prometheusRecorder) ObserveHTTPRequestTimeToFirstByte(_ context.Context, p HTTPReqProperties, duration time.Duration) {
+	r.httpRequestTTFBHistogram.WithLabelValues(reqLabelValues(p)...).Observe(duration.Seconds())
+}
+
+func (r *prometheusRecorder) ObserveHTTPRequestSize(_ context.Context, p HTTPReqProperties, sizeBytes int64) {
+	r.httpRequestSizeHistogram.WithLabelValues(reqLabelValues(p)...).Observe(float64(sizeBytes))
+}
+
+func (r *prometheusRecorder) ObserveHTTPResponseSize(_ context.Context, p HTTPReqProperties, sizeBytes int64) {
+	r.httpResponseSizeHistogram.WithLabelValues(reqLabelValues(p)...).Observe(float64(sizeBytes))
+}
+
+func (r *prometheusRecorder) AddInflightRequests(_ context.Context, p HTTPProperties, quantity int) {
+	r.httpRequestsInflight.WithLabelValues(p.ID).Add(float64(quantity))
+}
+
+func (r *prometheusRecorder) IncPanics(_ context.Context, p HTTPProperties) {
+	r.httpRequestPanics.WithLabelValues(p.ID).Inc()
+}
+
+func (r *prometheusRecorder) IncClientAbortedRequests(_ context.Context, p HTTPProperties) {
+	r.httpRequestsClientAborted.WithLabelValues(p.ID).Inc()
+}
+
+func (r *prometheusRecorder) IncHandlerLabelOverflow(_ context.Context) {
+	r.httpHandlerLabelOverflow.Inc()
+}
+
+const exemplarTraceIDLabel = "trace_id"
+
+// validExemplarTraceID returns true if the trace ID can be set on an exemplar. The trace ID
+// usually comes from the request (e.g a header), so an invalid one is ignored instead of
+// making the exemplar observation panic.
+func validExemplarTraceID(traceID string) bool {
+	if traceID == "" || !utf8.ValidString(traceID) {
+		return false
+	}
+
+	runes := utf8.RuneCountInString(exemplarTraceIDLabel) + utf8.RuneCountInString(traceID)
+	return runes <= prometheus.ExemplarMaxRunes
+}
@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"context"
+	"time"
+)
+
+// HTTPProperties are the metric properties for the HTTP metrics that
+// don't depend on the result of the request.
+type HTTPProperties struct {
+	// ID is the handler ID of the request (the `handler` label).
+	ID string
+}
+
+// HTTPReqProperties are the metric properties for the HTTP metrics of
+// a finished request.
+type HTTPReqProperties struct {
+	// ID is the handler ID of the request (the `handler` label).
+	ID string
+	// Method is the HTTP method of the request.
+	Method string
+	// Code is the status code of the response (grouped or not depending on the configuration).
+	Code string
+	// ExtraLabels are the extra labels of the request, always in the same order and
+	// with the same names for all the requests of a middleware.
+	ExtraLabels []Label
+	// TraceID is the trace ID of the request, only set on the request duration measurement
+	// when the trace ID extractor is configured and the request has a trace.
+	TraceID string
+}
+
+// Label is a metric label.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Recorder knows how to record and measure the HTTP metrics. The middleware
+// delegates the measurements to the recorder so the middleware can be used
+// with different metrics backends.
+type Recorder interface {
+	// IncRequests counts the HTTP requests.
+	IncRequests(ctx context.Context, props HTTPReqProperties)
+	// ObserveHTTPRequestDuration measures the duration of an HTTP request.
+	ObserveHTTPRequestDuration(ctx context.Context, props HTTPReqProperties, duration time.Duration)
+	// ObserveHTTPRequestTimeToFirstByte measures the duration of an HTTP request until the
+	// first byte of the response is written.
+	ObserveHTTPRequestTimeToFirstByte(ctx context.Context, props HTTPReqProperties, duration time.Duration)
+	// ObserveHTTPRequestSize measures the size of an HTTP request in bytes.
+	ObserveHTTPRequestSize(ctx context.Context, props HTTPReqProperties, sizeBytes int64)
+	// ObserveHTTPResponseSize measures the size of an HTTP response in bytes.
+	ObserveHTTPResponseSize(ctx context.Context, props HTTPReqProperties, sizeBytes int64)
+	// AddInflightRequests increments and decrements the number of inflight requests being
+	// processed.
+	AddInflightRequests(ctx context.Context, props HTTPProperties, quantity int)
+	// IncPanics counts the requests where the handler panicked.
+	IncPanics(ctx context.Context, props HTTPProperties)
+	// IncClientAbortedRequests counts the requests where the client disconnected before
+	// the handler finished.
+	IncClientAbortedRequests(ctx context.Context, props HTTPProperties)
+	// IncHandlerLabelOverflow counts the requests measured with the overflow handler ID
+	// because the handler label limit has been reached.
+	IncHandlerLabelOverflow(ctx context.Context)
+}
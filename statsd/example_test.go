@@ -0,0 +1,39 @@
+package statsd_test
+
+import (
+	"log"
+	"net/http"
+
+	prommiddleware "github.com/slok/go-prometheus-middleware"
+	promstatsd "github.com/slok/go-prometheus-middleware/statsd"
+)
+
+// StatsDMiddleware shows how you would create a middleware factory that sends
+// the metrics to a StatsD agent instead of using Prometheus.
+func Example_statsDMiddleware() {
+	// Create our StatsD recorder and the middleware factory using it.
+	rec, err := promstatsd.NewRecorder(promstatsd.Config{
+		Address: "127.0.0.1:8125",
+		Prefix:  "myapp",
+	})
+	if err != nil {
+		log.Panicf("error creating recorder: %s", err)
+	}
+	defer rec.Close()
+	mdlw := prommiddleware.NewWithRecorder(prommiddleware.Config{}, rec)
+
+	// Create our handler.
+	myHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello world!"))
+	})
+
+	// Wrap our handler with the middleware.
+	h := mdlw.Handler("", myHandler)
+
+	// Serve our handler.
+	log.Printf("listening at: %s", ":8080")
+	if err := http.ListenAndServe(":8080", h); err != nil {
+		log.Panicf("error while serving: %s", err)
+	}
+}
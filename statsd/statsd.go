@@ -0,0 +1,277 @@
+// Package statsd is a helper package to measure the HTTP metrics of the
+// Middleware factory (from github.com/slok/go-prometheus-middleware) sending
+// them to a StatsD agent instead of using Prometheus.
+// The metrics are sent over UDP using the DogStatsD tags extension to set the
+// `handler`, `method` and `code` tags.
+package statsd
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	prommiddleware "github.com/slok/go-prometheus-middleware"
+)
+
+// Config is the configuration for the StatsD recorder.
+type Config struct {
+	// Address is the UDP address of the StatsD agent, by default `127.0.0.1:8125`.
+	Address string
+	// Prefix is the prefix that will be set on the metrics, by default it will be empty.
+	Prefix string
+	// MaxPacketSize is the maximum size in bytes of the UDP packets, the metrics are
+	// buffered until the packet is full or the flush interval is reached. By default
+	// 1432 bytes (safe size for most networks). The metrics that don't fit on a packet
+	// by themselves are dropped.
+	MaxPacketSize int
+	// FlushInterval is the interval used to send the buffered metrics, by default 100ms.
+	FlushInterval time.Duration
+}
+
+func (c *Config) validate() {
+	if c.Address == "" {
+		c.Address = "127.0.0.1:8125"
+	}
+
+	if c.Prefix != "" && !strings.HasSuffix(c.Prefix, ".") {
+		c.Prefix += "."
+	}
+
+	if c.MaxPacketSize <= 0 {
+		c.MaxPacketSize = 1432
+	}
+
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = 100 * time.Millisecond
+	}
+}
+
+// Recorder is the StatsD implementation of the middleware Recorder. The metrics
+// are buffered and sent periodically, so the Recorder should be closed when it's
+// not used anymore to send the pending metrics.
+type Recorder struct {
+	conn net.Conn
+	cfg  Config
+
+	mu       sync.Mutex
+	buf      []byte
+	inflight map[string]int64
+	closed   bool
+
+	closeOnce sync.Once
+	closeErr  error
+	stopC     chan struct{}
+	doneC     chan struct{}
+}
+
+// NewRecorder returns a middleware Recorder that sends the HTTP metrics to a
+// StatsD agent, use it with the middleware NewWithRecorder factory.
+func NewRecorder(cfg Config) (*Recorder, error) {
+	cfg.validate()
+
+	conn, err := net.Dial("udp", cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Recorder{
+		conn:     conn,
+		cfg:      cfg,
+		buf:      make([]byte, 0, cfg.MaxPacketSize),
+		inflight: map[string]int64{},
+		stopC:    make(chan struct{}),
+		doneC:    make(chan struct{}),
+	}
+
+	go r.flushLoop()
+
+	return r, nil
+}
+
+// IncRequests satisfies middleware.Recorder interface.
+func (r *Recorder) IncRequests(_ context.Context, p prommiddleware.HTTPReqProperties) {
+	r.send("http.requests", "1", "c", reqTags(p))
+}
+
+// ObserveHTTPRequestDuration satisfies middleware.Recorder interface.
+func (r *Recorder) ObserveHTTPRequestDuration(_ context.Context, p prommiddleware.HTTPReqProperties, duration time.Duration) {
+	ms := float64(duration) / float64(time.Millisecond)
+	r.send("http.request.duration", strconv.FormatFloat(ms, 'f', -1, 64), "ms", reqTags(p))
+}
+
+// ObserveHTTPRequestTimeToFirstByte satisfies middleware.Recorder interface.
+func (r *Recorder) ObserveHTTPRequestTimeToFirstByte(_ context.Context, p prommiddleware.HTTPReqProperties, duration time.Duration) {
+	ms := float64(duration) / float64(time.Millisecond)
+	r.send("http.request.ttfb", strconv.FormatFloat(ms, 'f', -1, 64), "ms", reqTags(p))
+}
+
+// ObserveHTTPRequestSize satisfies middleware.Recorder interface.
+func (r *Recorder) ObserveHTTPRequestSize(_ context.Context, p prommiddleware.HTTPReqProperties, sizeBytes int64) {
+	r.send("http.request.size", strconv.FormatInt(sizeBytes, 10), "h", reqTags(p))
+}
+
+// ObserveHTTPResponseSize satisfies middleware.Recorder interface.
+func (r *Recorder) ObserveHTTPResponseSize(_ context.Context, p prommiddleware.HTTPReqProperties, sizeBytes int64) {
+	r.send("http.response.size", strconv.FormatInt(sizeBytes, 10), "h", reqTags(p))
+}
+
+// AddInflightRequests satisfies middleware.Recorder interface. Relative gauges are
+// not supported by DogStatsD so the recorder tracks the inflight requests and sends
+// the absolute value.
+func (r *Recorder) AddInflightRequests(_ context.Context, p prommiddleware.HTTPProperties, quantity int) {
+	// The absolute values need to be buffered in the same order they are computed,
+	// otherwise the agent could end with a stale value.
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	value := r.inflight[p.ID] + int64(quantity)
+	if value == 0 {
+		// Don't keep the handlers without inflight requests, the handler IDs could be unbounded.
+		delete(r.inflight, p.ID)
+	} else {
+		r.inflight[p.ID] = value
+	}
+
+	r.sendLocked(metricLine(r.cfg.Prefix, "http.requests.inflight", strconv.FormatInt(value, 10), "g", []string{"handler:" + sanitizeTag(p.ID)}))
+}
+
+// IncPanics satisfies middleware.Recorder interface.
+func (r *Recorder) IncPanics(_ context.Context, p prommiddleware.HTTPProperties) {
+	r.send("http.request.panics", "1", "c", []string{"handler:" + sanitizeTag(p.ID)})
+}
+
+// IncClientAbortedRequests satisfies middleware.Recorder interface.
+func (r *Recorder) IncClientAbortedRequests(_ context.Context, p prommiddleware.HTTPProperties) {
+	r.send("http.requests.client_aborted", "1", "c", []string{"handler:" + sanitizeTag(p.ID)})
+}
+
+// IncHandlerLabelOverflow satisfies middleware.Recorder interface.
+func (r *Recorder) IncHandlerLabelOverflow(_ context.Context) {
+	r.send("http.handler_label.overflow", "1", "c", nil)
+}
+
+// Flush sends the buffered metrics to the StatsD agent.
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.flush()
+}
+
+// Close flushes the buffered metrics and stops the recorder, the metrics recorded
+// after closing it are ignored. It's safe to call it multiple times.
+func (r *Recorder) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.stopC)
+		<-r.doneC
+
+		r.mu.Lock()
+		r.closed = true
+		err := r.flush()
+		r.mu.Unlock()
+
+		if cerr := r.conn.Close(); err == nil {
+			err = cerr
+		}
+		r.closeErr = err
+	})
+
+	return r.closeErr
+}
+
+func (r *Recorder) flushLoop() {
+	defer close(r.doneC)
+
+	t := time.NewTicker(r.cfg.FlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.stopC:
+			return
+		case <-t.C:
+			// StatsD is best effort, we don't care about the errors.
+			_ = r.Flush()
+		}
+	}
+}
+
+// send adds the metric to the buffer, if the buffer doesn't have space
+// for the metric, the buffer will be flushed first.
+func (r *Recorder) send(name, value, kind string, tags []string) {
+	line := metricLine(r.cfg.Prefix, name, value, kind, tags)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sendLocked(line)
+}
+
+// sendLocked is like send but with the metric line already formatted, needs to be
+// called with the lock acquired.
+func (r *Recorder) sendLocked(line string) {
+	// A metric that doesn't fit on a packet would be truncated or dropped
+	// by the network, so we don't send it.
+	if len(line) > r.cfg.MaxPacketSize {
+		return
+	}
+
+	// Nobody will flush the buffer after closing the recorder.
+	if r.closed {
+		return
+	}
+
+	// Metrics are separated by new lines on the same packet.
+	size := len(line)
+	if len(r.buf) > 0 {
+		size++
+	}
+	if len(r.buf)+size > r.cfg.MaxPacketSize {
+		// StatsD is best effort, we don't care about the errors.
+		_ = r.flush()
+	}
+
+	if len(r.buf) > 0 {
+		r.buf = append(r.buf, '\n')
+	}
+	r.buf = append(r.buf, line...)
+}
+
+// flush sends the buffer, needs to be called with the lock acquired.
+func (r *Recorder) flush() error {
+	if len(r.buf) == 0 {
+		return nil
+	}
+
+	_, err := r.conn.Write(r.buf)
+	r.buf = r.buf[:0]
+	return err
+}
+
+// metricLine formats the metric using the DogStatsD protocol.
+func metricLine(prefix, name, value, kind string, tags []string) string {
+	line := prefix + name + ":" + value + "|" + kind
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+func reqTags(p prommiddleware.HTTPReqProperties) []string {
+	tags := []string{
+		"handler:" + sanitizeTag(p.ID),
+		"method:" + sanitizeTag(p.Method),
+		"code:" + sanitizeTag(p.Code),
+	}
+	for _, l := range p.ExtraLabels {
+		tags = append(tags, sanitizeTag(l.Name)+":"+sanitizeTag(l.Value))
+	}
+	return tags
+}
+
+var tagReplacer = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+// sanitizeTag removes the characters that have special meaning on the DogStatsD protocol.
+func sanitizeTag(v string) string {
+	return tagReplacer.Replace(v)
+}
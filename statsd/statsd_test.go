@@ -0,0 +1,271 @@
+package statsd_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	prommiddleware "github.com/slok/go-prometheus-middleware"
+	promstatsd "github.com/slok/go-prometheus-middleware/statsd"
+)
+
+// readPackets reads the UDP packets received by the listener until the timeout.
+func readPackets(t *testing.T, conn net.PacketConn, timeout time.Duration) []string {
+	var packets []string
+	buf := make([]byte, 65535)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return packets
+		}
+		packets = append(packets, string(buf[:n]))
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        promstatsd.Config
+		mdlwConfig    prommiddleware.Config
+		requests      int
+		expPackets    int
+		expDuration   string
+		expMetrics    []string
+		expNotMetrics []string
+	}{
+		{
+			name:        "Measuring with the default configuration should buffer all the metrics on the same packet.",
+			config:      promstatsd.Config{},
+			requests:    1,
+			expPackets:  1,
+			expDuration: `(^|\n)http\.request\.duration:[0-9.]+\|ms\|#handler:/test,method:POST,code:202`,
+			expMetrics: []string{
+				`http.requests.inflight:1|g|#handler:/test`,
+				`http.requests:1|c|#handler:/test,method:POST,code:202`,
+				`http.request.size:4|h|#handler:/test,method:POST,code:202`,
+				`http.response.size:12|h|#handler:/test,method:POST,code:202`,
+				`http.requests.inflight:0|g|#handler:/test`,
+			},
+		},
+		{
+			name: "Measuring with a prefix and grouped status should send the metrics with the prefix and the grouped code tag except the requests counter.",
+			config: promstatsd.Config{
+				Prefix: "batman",
+			},
+			mdlwConfig:  prommiddleware.Config{GroupedStatus: true},
+			requests:    1,
+			expPackets:  1,
+			expDuration: `(^|\n)batman\.http\.request\.duration:[0-9.]+\|ms\|#handler:/test,method:POST,code:2xx`,
+			expMetrics: []string{
+				`batman.http.requests:1|c|#handler:/test,method:POST,code:202`,
+				`batman.http.request.size:4|h|#handler:/test,method:POST,code:2xx`,
+				`batman.http.response.size:12|h|#handler:/test,method:POST,code:2xx`,
+			},
+			expNotMetrics: []string{
+				`batman.http.request.size:4|h|#handler:/test,method:POST,code:202`,
+				`batman.http.response.size:12|h|#handler:/test,method:POST,code:202`,
+			},
+		},
+		{
+			name: "Measuring with a small packet size should split the metrics in multiple packets.",
+			config: promstatsd.Config{
+				MaxPacketSize: 100,
+			},
+			requests:    2,
+			expPackets:  12,
+			expDuration: `(^|\n)http\.request\.duration:[0-9.]+\|ms\|#handler:/test,method:POST,code:202`,
+			expMetrics: []string{
+				`http.requests.inflight:1|g|#handler:/test`,
+				`http.request.size:4|h|#handler:/test,method:POST,code:202`,
+				`http.response.size:12|h|#handler:/test,method:POST,code:202`,
+				`http.requests.inflight:0|g|#handler:/test`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			// Our fake StatsD agent.
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			require.NoError(err)
+			defer conn.Close()
+
+			// Don't flush automatically during the test.
+			test.config.Address = conn.LocalAddr().String()
+			test.config.FlushInterval = time.Hour
+			rec, err := promstatsd.NewRecorder(test.config)
+			require.NoError(err)
+
+			m := prommiddleware.NewWithRecorder(test.mdlwConfig, rec)
+			h := m.Handler("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.ReadAll(r.Body)
+				w.WriteHeader(http.StatusAccepted)
+				w.Write([]byte("hello world!"))
+			}))
+			for i := 0; i < test.requests; i++ {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/test", strings.NewReader("test")))
+			}
+			require.NoError(rec.Close())
+
+			packets := readPackets(t, conn, 200*time.Millisecond)
+			assert.Len(packets, test.expPackets)
+			maxSize := 1432
+			if test.config.MaxPacketSize > 0 {
+				maxSize = test.config.MaxPacketSize
+			}
+			for _, p := range packets {
+				assert.True(len(p) <= maxSize, "packet is bigger than the max size")
+			}
+
+			// Check the metrics.
+			all := strings.Join(packets, "\n")
+			assert.Regexp(test.expDuration, all)
+			for _, expMetric := range test.expMetrics {
+				assert.Contains(all, expMetric)
+			}
+			for _, expNotMetric := range test.expNotMetrics {
+				assert.NotContains(all, expNotMetric)
+			}
+		})
+	}
+}
+
+func TestRecorderFlushInterval(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(err)
+	defer conn.Close()
+
+	rec, err := promstatsd.NewRecorder(promstatsd.Config{
+		Address:       conn.LocalAddr().String(),
+		FlushInterval: 10 * time.Millisecond,
+	})
+	require.NoError(err)
+	defer rec.Close()
+
+	m := prommiddleware.NewWithRecorder(prommiddleware.Config{}, rec)
+	m.Handler("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	// Without closing or flushing, the metrics should be sent.
+	packets := readPackets(t, conn, 200*time.Millisecond)
+	if assert.Len(packets, 1) {
+		assert.Contains(packets[0], `http.response.size:0|h|#handler:test,method:GET,code:200`)
+	}
+}
+
+func TestRecorderClose(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(err)
+	defer conn.Close()
+
+	rec, err := promstatsd.NewRecorder(promstatsd.Config{
+		Address:       conn.LocalAddr().String(),
+		FlushInterval: time.Hour,
+	})
+	require.NoError(err)
+
+	m := prommiddleware.NewWithRecorder(prommiddleware.Config{}, rec)
+	h := m.Handler("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	// Closing multiple times should not fail.
+	assert.NoError(rec.Close())
+	assert.NoError(rec.Close())
+
+	// The metrics recorded after closing should be ignored.
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.NoError(rec.Flush())
+
+	packets := readPackets(t, conn, 200*time.Millisecond)
+	assert.Len(packets, 1)
+}
+
+func TestRecorderOversizedMetric(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(err)
+	defer conn.Close()
+
+	rec, err := promstatsd.NewRecorder(promstatsd.Config{
+		Address:       conn.LocalAddr().String(),
+		MaxPacketSize: 100,
+		FlushInterval: time.Hour,
+	})
+	require.NoError(err)
+
+	m := prommiddleware.NewWithRecorder(prommiddleware.Config{}, rec)
+	m.Handler(strings.Repeat("a", 100), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	m.Handler("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	require.NoError(rec.Close())
+
+	// The metrics that don't fit on a packet should be dropped.
+	packets := readPackets(t, conn, 200*time.Millisecond)
+	all := strings.Join(packets, "\n")
+	for _, p := range packets {
+		assert.True(len(p) <= 100, "packet is bigger than the max size")
+	}
+	assert.NotContains(all, "handler:aaa")
+	assert.Contains(all, `http.response.size:0|h|#handler:test,method:GET,code:200`)
+}
+
+func TestRecorderInflightRequestsConcurrency(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(err)
+	defer conn.Close()
+
+	rec, err := promstatsd.NewRecorder(promstatsd.Config{
+		Address:       conn.LocalAddr().String(),
+		FlushInterval: time.Hour,
+	})
+	require.NoError(err)
+
+	m := prommiddleware.NewWithRecorder(prommiddleware.Config{}, rec)
+	h := m.Handler("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}()
+	}
+	wg.Wait()
+	require.NoError(rec.Close())
+
+	// The last inflight value sent should be the current one.
+	var last string
+	for _, p := range readPackets(t, conn, 200*time.Millisecond) {
+		for _, line := range strings.Split(p, "\n") {
+			if strings.HasPrefix(line, "http.requests.inflight:") {
+				last = line
+			}
+		}
+	}
+	assert.Equal(`http.requests.inflight:0|g|#handler:test`, last)
+}
@@ -0,0 +1,20 @@
+package middleware
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OTelTraceID returns the trace ID of the OpenTelemetry span context carried by
+// the request context, it can be used as the Config.TraceIDExtractor. Only the
+// sampled traces are returned because the not sampled ones can't be found on
+// the tracing backend.
+func OTelTraceID(r *http.Request) string {
+	sc := trace.SpanContextFromContext(r.Context())
+	if !sc.HasTraceID() || !sc.IsSampled() {
+		return ""
+	}
+
+	return sc.TraceID().String()
+}